@@ -0,0 +1,328 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNoHashChain is returned when a hash chain operation is used on a pipe without one
+	ErrNoHashChain = errors.New("pipe has no hash chain")
+	// ErrCheckpointSignature is returned when a checkpoint was not signed by the key given
+	ErrCheckpointSignature = errors.New("checkpoint signature is not valid")
+	// ErrCheckpointMismatch is returned when the lines of a pipe differ from those a checkpoint
+	// was made of
+	ErrCheckpointMismatch = errors.New("checkpoint does not match the pipe")
+	// ErrCheckpointFormat is returned when unmarshalling a checkpoint that is not one
+	ErrCheckpointFormat = errors.New("invalid checkpoint")
+)
+
+// ChainError reports the first line whose hash does not follow from the hash of the line before
+// it and the data of the line, as left by editing lines of a hash chained pipe
+type ChainError struct {
+	Line int64
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("bufpipe: hash chain broken at line %d", e.Line)
+}
+
+const hashSize = sha256.Size
+
+// checkpointContext is signed ahead of a checkpoint so the signature is not valid for anything else
+const checkpointContext = "bufpipe hash chain checkpoint\n"
+
+// Checkpoint is a signed statement of the head of a hash chain, the hash of the last of Lines
+// lines. Published checkpoints show lines before them have not been changed since, even by
+// someone able to rewrite the chain, see VerifyCheckpoint.
+type Checkpoint struct {
+	Lines     int64
+	Head      [hashSize]byte
+	Signature []byte
+}
+
+// ChainHead returns the number of lines in the hash chain and the hash of the last of them
+func (l *LineIndexedPipe) ChainHead() (lines int64, head [hashSize]byte, err error) {
+	if l.chain == nil {
+		return 0, head, ErrNoHashChain
+	}
+
+	l.wl.Lock()
+	defer l.wl.Unlock()
+
+	if err = l.verifiable(); err != nil {
+		return
+	}
+
+	// Lines written without the chain have no hashes until the next write adds them
+	var size int64
+	if size, err = l.chain.Size(); err != nil {
+		return 0, head, pipeError("size", "chain", err)
+	}
+	if lines = size / hashSize; lines > l.lines {
+		lines = l.lines
+	}
+	if lines > 0 {
+		err = pipeError("read", "chain", readAt(l.chain, (lines-1)*hashSize, &head))
+	}
+
+	return
+}
+
+// Checkpoint returns the head of the hash chain signed with key
+func (l *LineIndexedPipe) Checkpoint(key ed25519.PrivateKey) (*Checkpoint, error) {
+	lines, head, err := l.ChainHead()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Checkpoint{Lines: lines, Head: head}
+	c.Signature = ed25519.Sign(key, c.message())
+
+	return c, nil
+}
+
+// VerifyCheckpoint checks c was signed with the private key of key and that the lines it was
+// made of have the same hashes. Along with VerifyChain this shows the lines before the
+// checkpoint are unchanged.
+func (l *LineIndexedPipe) VerifyCheckpoint(c *Checkpoint, key ed25519.PublicKey) error {
+	if l.chain == nil {
+		return ErrNoHashChain
+	}
+	if !c.Verify(key) {
+		return ErrCheckpointSignature
+	}
+	if c.Lines == 0 {
+		return nil
+	}
+
+	l.wl.Lock()
+	defer l.wl.Unlock()
+
+	if err := l.verifiable(); err != nil {
+		return err
+	}
+
+	hashes, err := l.readHashes(c.Lines-1, 1)
+	if err != nil {
+		return err
+	}
+	if c.Lines > l.lines || len(hashes) == 0 || hashes[0] != c.Head {
+		return ErrCheckpointMismatch
+	}
+
+	return nil
+}
+
+// VerifyChain reads every line checking its hash follows from the hash of the line before and
+// the data of the line, a *ChainError names the first that does not. Lines written before the
+// chain was enabled are checked once the next write has added their hashes.
+func (l *LineIndexedPipe) VerifyChain() error {
+	if l.chain == nil {
+		return ErrNoHashChain
+	}
+
+	for first := int64(0); ; first += verifyBatch {
+		bounds, prev, hashes, err := l.chainBounds(first)
+		if err != nil || len(hashes) == 0 {
+			return err
+		}
+
+		for i, want := range hashes {
+			h := sha256.New()
+			h.Write(prev[:])
+			if err = l.hashData(h, bounds[i], bounds[i+1]); err != nil {
+				return err
+			}
+			if !bytes.Equal(h.Sum(nil), want[:]) {
+				return &ChainError{Line: first + int64(i)}
+			}
+			prev = want
+		}
+	}
+}
+
+// Verify reports whether the checkpoint was signed with the private key of key
+func (c *Checkpoint) Verify(key ed25519.PublicKey) bool {
+	return ed25519.Verify(key, c.message(), c.Signature)
+}
+
+// MarshalBinary encodes the checkpoint as the little endian int64 number of lines followed by
+// the head and the signature
+func (c *Checkpoint) MarshalBinary() ([]byte, error) {
+	b := binary.LittleEndian.AppendUint64(make([]byte, 0, int64Size+hashSize+len(c.Signature)), uint64(c.Lines))
+	b = append(b, c.Head[:]...)
+	return append(b, c.Signature...), nil
+}
+
+// UnmarshalBinary decodes a checkpoint encoded by MarshalBinary
+func (c *Checkpoint) UnmarshalBinary(b []byte) error {
+	if len(b) != int64Size+hashSize+ed25519.SignatureSize {
+		return ErrCheckpointFormat
+	}
+	c.Lines = int64(binary.LittleEndian.Uint64(b))
+	copy(c.Head[:], b[int64Size:])
+	c.Signature = append([]byte(nil), b[int64Size+hashSize:]...)
+	return nil
+}
+
+// message returns what is signed for the checkpoint
+func (c *Checkpoint) message() []byte {
+	b := binary.LittleEndian.AppendUint64([]byte(checkpointContext), uint64(c.Lines))
+	return append(b, c.Head[:]...)
+}
+
+// chainBounds returns where the lines of the batch starting at first begin and end, the hash of
+// the line before and their hashes
+func (l *LineIndexedPipe) chainBounds(first int64) (bounds []int64, prev [hashSize]byte, hashes [][hashSize]byte, err error) {
+	l.wl.Lock()
+	defer l.wl.Unlock()
+
+	if err = l.verifiable(); err != nil {
+		return
+	}
+
+	count := l.lines - first
+	if count > verifyBatch {
+		count = verifyBatch
+	}
+	from := first
+	if first > 0 {
+		from, count = first-1, count+1
+	}
+	if hashes, err = l.readHashes(from, count); err != nil || len(hashes) == 0 {
+		return
+	}
+	if first > 0 {
+		prev, hashes = hashes[0], hashes[1:]
+		if len(hashes) == 0 {
+			return
+		}
+	}
+
+	bounds, err = l.lineBounds(first, int64(len(hashes)))
+	return
+}
+
+// readHashes reads the hashes of up to count lines from first, fewer if some lines have none
+func (l *LineIndexedPipe) readHashes(first, count int64) (hashes [][hashSize]byte, err error) {
+	size, err := l.chain.Size()
+	if err != nil {
+		return nil, pipeError("size", "chain", err)
+	}
+	if have := size/hashSize - first; have < count {
+		count = have
+	}
+	if count <= 0 {
+		return nil, nil
+	}
+
+	hashes = make([][hashSize]byte, count)
+	return hashes, pipeError("read", "chain", readAt(l.chain, first*hashSize, hashes))
+}
+
+// writeHash records the hash of the line that has been completed, tail is the end of it that
+// has just been written and next is where the following line starts
+func (l *LineIndexedPipe) writeHash(line int64, tail []byte, next int64) (err error) {
+	if !l.chainRead {
+		if err = l.loadChain(line); err != nil {
+			return
+		}
+	}
+
+	h := sha256.New()
+	h.Write(l.head[:])
+	if next-int64(len(tail)) == l.lastIndex {
+		h.Write(tail)
+	} else if err = l.hashData(h, l.lastIndex, next); err != nil {
+		return
+	}
+
+	var head [hashSize]byte
+	h.Sum(head[:0])
+	if _, err = l.chain.Append(head[:]); err != nil {
+		return pipeError("write", "chain", err)
+	}
+
+	if err = l.syncData(l.chain); err != nil {
+		return pipeError("sync", "chain", err)
+	}
+
+	l.head = head
+
+	return
+}
+
+// loadChain has the chain end at line, dropping any hash recorded for it by a failed index write
+// and adding those of lines written without them fillBatch at a time, then reads the hash of the
+// line before line
+func (l *LineIndexedPipe) loadChain(line int64) (err error) {
+	size, err := l.chain.Size()
+	if err != nil {
+		return pipeError("size", "chain", err)
+	}
+
+	have := size / hashSize
+	if have > line {
+		have = line
+	}
+	if size != have*hashSize {
+		if err = l.chain.Truncate(have * hashSize); err != nil {
+			return pipeError("truncate", "chain", err)
+		}
+	}
+
+	l.head = [hashSize]byte{}
+	if have > 0 {
+		if err = readAt(l.chain, (have-1)*hashSize, &l.head); err != nil {
+			return pipeError("read", "chain", err)
+		}
+	}
+
+	if have < line {
+		var start int64
+		if start, err = l.lineOffset(have); err != nil {
+			return
+		}
+		buf := make([]byte, 0, fillBatch*hashSize)
+		var hashErr error
+		err = l.scanData(start, l.lastIndex, func(end int64) bool {
+			h := sha256.New()
+			h.Write(l.head[:])
+			if hashErr = l.hashData(h, start, end); hashErr != nil {
+				return false
+			}
+			h.Sum(l.head[:0])
+			if buf = append(buf, l.head[:]...); len(buf) == cap(buf) {
+				if _, hashErr = l.chain.Append(buf); hashErr != nil {
+					hashErr = pipeError("write", "chain", hashErr)
+					return false
+				}
+				buf = buf[:0]
+			}
+			start = end
+			return true
+		})
+		if err != nil {
+			return
+		}
+		if hashErr != nil {
+			return hashErr
+		}
+		if len(buf) > 0 {
+			if _, err = l.chain.Append(buf); err != nil {
+				return pipeError("write", "chain", err)
+			}
+		}
+	}
+	l.chainRead = true
+
+	return
+}
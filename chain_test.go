@@ -0,0 +1,190 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Ladbrokes/bufpipe"
+	"github.com/Ladbrokes/bufpipe/mock"
+)
+
+// chainHashes returns the hash chain of lines
+func chainHashes(lines ...string) (hashes [][sha256.Size]byte) {
+	var prev [sha256.Size]byte
+	for _, line := range lines {
+		prev = sha256.Sum256(append(prev[:], line...))
+		hashes = append(hashes, prev)
+	}
+	return
+}
+
+func TestNoHashChainPipe(t *testing.T) {
+	p := bufpipe.NewLineIndexedPipe(&mock.ReadWriteSeekable{}, &mock.ReadWriteSeekable{})
+
+	if err := p.VerifyChain(); err != bufpipe.ErrNoHashChain {
+		t.Errorf("Expected %v got %v", bufpipe.ErrNoHashChain, err)
+	}
+	if _, _, err := p.ChainHead(); err != bufpipe.ErrNoHashChain {
+		t.Errorf("Expected %v got %v", bufpipe.ErrNoHashChain, err)
+	}
+}
+
+func TestHashChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testchain")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, index, chain := filepath.Join(dir, "data"), filepath.Join(dir, "index"), filepath.Join(dir, "chain")
+
+	p, err := bufpipe.OpenLineIndexedFilePipe(data, index, 0666, bufpipe.WithHashChainFile(chain))
+	if err != nil {
+		t.Fatal("Unable to create IndexedFile object", err)
+	}
+	defer p.Close()
+
+	p.Write([]byte("Hello\nWor"))
+	p.Write([]byte("ld\nFoo\n"))
+
+	if err := p.VerifyChain(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	hashes := chainHashes("Hello\n", "World\n", "Foo\n")
+	if lines, head, err := p.ChainHead(); lines != 3 || head != hashes[2] || err != nil {
+		t.Errorf("Expected [%v, %x, %v] got [%v, %x, %v]", 3, hashes[2], nil, lines, head, err)
+	}
+
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal("Unable to generate key", err)
+	}
+	c, err := p.Checkpoint(key)
+	if err != nil {
+		t.Fatal("Unable to make checkpoint", err)
+	}
+
+	b, _ := c.MarshalBinary()
+	exported := &bufpipe.Checkpoint{}
+	if err := exported.UnmarshalBinary(b); err != nil {
+		t.Fatal("Unable to unmarshal checkpoint", err)
+	}
+	if err := p.VerifyCheckpoint(exported, pub); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	other, _, _ := ed25519.GenerateKey(nil)
+	if err := p.VerifyCheckpoint(exported, other); err != bufpipe.ErrCheckpointSignature {
+		t.Errorf("Expected %v got %v", bufpipe.ErrCheckpointSignature, err)
+	}
+
+	// Lines written after the checkpoint do not change it
+	p.Write([]byte("Bar\n"))
+	if err := p.VerifyCheckpoint(exported, pub); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	corrupt(t, data, 7)
+
+	var cerr *bufpipe.ChainError
+	if err := p.VerifyChain(); !errors.As(err, &cerr) || cerr.Line != 1 {
+		t.Errorf("Expected %v got %v", &bufpipe.ChainError{Line: 1}, err)
+	}
+
+	// Rewriting the chain to match hides the change from VerifyChain but not the checkpoint
+	f, err := os.OpenFile(chain, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal("Unable to open chain", err)
+	}
+	for i, h := range chainHashes("Hello\n", "WOrld\n", "Foo\n", "Bar\n") {
+		f.WriteAt(h[:], int64(i*sha256.Size))
+	}
+	f.Close()
+
+	if err := p.VerifyChain(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if err := p.VerifyCheckpoint(exported, pub); err != bufpipe.ErrCheckpointMismatch {
+		t.Errorf("Expected %v got %v", bufpipe.ErrCheckpointMismatch, err)
+	}
+}
+
+func TestHashChainAdded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testchain")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, index, chain := filepath.Join(dir, "data"), filepath.Join(dir, "index"), filepath.Join(dir, "chain")
+
+	p, err := bufpipe.OpenLineIndexedFilePipe(data, index, 0666, bufpipe.WithSparseIndex(bufpipe.IndexInterval{Lines: 2}))
+	if err != nil {
+		t.Fatal("Unable to create IndexedFile object", err)
+	}
+	p.Write([]byte("one\ntwo\nthree\n"))
+	p.Close()
+
+	p, err = bufpipe.OpenLineIndexedFilePipe(data, index, 0666, bufpipe.WithHashChainFile(chain))
+	if err != nil {
+		t.Fatal("Unable to reopen IndexedFile object", err)
+	}
+	defer p.Close()
+
+	// Lines written without the chain are added to it by the next write
+	if lines, _, err := p.ChainHead(); lines != 0 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 0, nil, lines, err)
+	}
+
+	p.Write([]byte("four\n"))
+
+	hashes := chainHashes("one\n", "two\n", "three\n", "four\n")
+	if lines, head, err := p.ChainHead(); lines != 4 || head != hashes[3] || err != nil {
+		t.Errorf("Expected [%v, %x, %v] got [%v, %x, %v]", 4, hashes[3], nil, lines, head, err)
+	}
+
+	corrupt(t, data, 9)
+
+	var cerr *bufpipe.ChainError
+	if err := p.VerifyChain(); !errors.As(err, &cerr) || cerr.Line != 2 {
+		t.Errorf("Expected %v got %v", &bufpipe.ChainError{Line: 2}, err)
+	}
+}
+
+func TestHashChainAddedBatches(t *testing.T) {
+	data, index, chain := bufpipe.NewMemoryStorage(), bufpipe.NewMemoryStorage(), bufpipe.NewMemoryStorage()
+
+	p, _ := bufpipe.OpenLineIndexedStoragePipe(data, index)
+	p.Write(bytes.Repeat([]byte("line\n"), 10000))
+
+	p, err := bufpipe.OpenLineIndexedStoragePipe(data, index, bufpipe.WithHashChain(chain))
+	if err != nil {
+		t.Fatal("Unable to reopen pipe", err)
+	}
+	defer p.Close()
+
+	p.Write([]byte("last\n"))
+
+	lines := make([]string, 10001)
+	for i := range lines[:10000] {
+		lines[i] = "line\n"
+	}
+	lines[10000] = "last\n"
+	hashes := chainHashes(lines...)
+	if n, head, err := p.ChainHead(); n != 10001 || head != hashes[10000] || err != nil {
+		t.Errorf("Expected [%v, %x, %v] got [%v, %x, %v]", 10001, hashes[10000], nil, n, head, err)
+	}
+	if err := p.VerifyChain(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
@@ -0,0 +1,420 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// ErrNoChecksums is returned when verifying a pipe without checksums
+var ErrNoChecksums = errors.New("pipe has no checksums")
+
+// ChecksumError reports lines whose data does not match the checksum recorded when they were
+// written
+type ChecksumError struct {
+	Lines []int64
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("bufpipe: checksum mismatch in lines %v", e.Lines)
+}
+
+const (
+	sumSize = 4
+	// verifyBatch is the number of lines Verify finds with the write lock held
+	verifyBatch = 1024
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// lineCursor is where the last verified read ended, the line it ended in and where that starts
+type lineCursor struct {
+	offset int64
+	line   int64
+	start  int64
+}
+
+// Read implements the standard Read interface, see Pipe.Read. With checksums every line that
+// ends in the data read is verified, a *ChecksumError naming those that do not match is returned
+// with the data. It does not stop the pipe, the next Read continues after the damaged lines.
+// ReadAt, View, snapshots and consumers return the data unchecked.
+func (l *LineIndexedPipe) Read(d []byte) (n int, err error) {
+	if l.sums == nil {
+		return l.Pipe.Read(d)
+	}
+
+	offset, n, err := l.read(d)
+	if err != nil {
+		return
+	}
+
+	return n, l.verifyRead(d[:n], offset)
+}
+
+// WriteTo implements the io.WriterTo interface, see Pipe.WriteTo. With checksums the data is
+// copied through a buffer so the lines ending in it are verified as Read does, a *ChecksumError
+// is returned once the data it was found in has been written.
+func (l *LineIndexedPipe) WriteTo(w io.Writer) (n int64, err error) {
+	if l.sums == nil {
+		return l.Pipe.WriteTo(w)
+	}
+
+	buf := make([]byte, copyBufferSize)
+	for {
+		offset, length, err := l.claim(int64(len(buf)))
+		if err != nil {
+			return n, err
+		}
+
+		c, rerr := l.readData(buf[:length], offset)
+		c, werr := w.Write(buf[:c])
+		n += int64(c)
+		if rerr != nil || werr != nil {
+			l.unclaim(offset+int64(c), offset+length)
+		}
+		l.finish(rerr)
+
+		// Verifying waits on writers, which may be waiting for reads to finish
+		if verr := l.verifyRead(buf[:c], offset); verr != nil {
+			return n, verr
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+		if werr != nil {
+			return n, werr
+		}
+	}
+}
+
+// Verify reads every line checking it against its checksum, returning the lines that do not
+// match. Lines are found from the index so a damaged line does not move those after it. Lines
+// written before checksums were enabled are checked once the next write has added theirs.
+func (l *LineIndexedPipe) Verify() (corrupt []int64, err error) {
+	if l.sums == nil {
+		return nil, ErrNoChecksums
+	}
+
+	for first := int64(0); ; first += verifyBatch {
+		var bounds []int64
+		var sums []uint32
+		if bounds, sums, err = l.verifyBounds(first); err != nil || len(sums) == 0 {
+			return
+		}
+
+		for i, want := range sums {
+			var sum uint32
+			if sum, err = l.lineSum(bounds[i], bounds[i+1]); err != nil {
+				return
+			}
+			if sum != want {
+				corrupt = append(corrupt, first+int64(i))
+			}
+		}
+	}
+}
+
+// verifyBounds returns where the lines of the batch starting at first begin and end, and their
+// checksums. The data of complete lines does not change so it can be read without the write lock.
+func (l *LineIndexedPipe) verifyBounds(first int64) (bounds []int64, sums []uint32, err error) {
+	l.wl.Lock()
+	defer l.wl.Unlock()
+
+	if err = l.verifiable(); err != nil {
+		return
+	}
+
+	count := l.lines - first
+	if count > verifyBatch {
+		count = verifyBatch
+	}
+	if sums, err = l.readSums(first, count); err != nil || len(sums) == 0 {
+		return
+	}
+
+	bounds, err = l.lineBounds(first, int64(len(sums)))
+	return
+}
+
+// verifiable loads a pipe that has not been closed for verifying. The caller must hold wl.
+func (l *LineIndexedPipe) verifiable() error {
+	l.l.Lock()
+	closed := l.closed
+	l.l.Unlock()
+	if closed {
+		return io.ErrClosedPipe
+	}
+
+	return l.load()
+}
+
+// lineBounds returns where count lines from first begin and end. Lines are found from the index
+// so a damaged line does not move those after it. The caller must hold wl.
+func (l *LineIndexedPipe) lineBounds(first, count int64) (bounds []int64, err error) {
+	start, err := l.lineOffset(first)
+	if err != nil {
+		return
+	}
+	bounds = append(make([]int64, 0, count+1), start)
+
+	indexed := l.lines - l.unindexed
+	for line := first + 1; line <= first+count; line++ {
+		end := l.lastIndex
+		if line < l.lines {
+			var found int64
+			if line < indexed {
+				if found, end, err = l.indexer.find(line); err != nil {
+					return nil, pipeError("read", "index", err)
+				}
+			}
+			if line >= indexed || found != line {
+				// Lines between those in a sparse index end at the next delimiter
+				end = l.lastIndex
+				if err = l.scanData(start, l.lastIndex, func(e int64) bool {
+					end = e
+					return false
+				}); err != nil {
+					return
+				}
+			}
+		}
+		bounds = append(bounds, end)
+		start = end
+	}
+
+	return
+}
+
+// verifyRead checks the lines ending in p, which was read from offset
+func (l *LineIndexedPipe) verifyRead(p []byte, offset int64) error {
+	line, start, err := l.lineAt(offset)
+	if err != nil {
+		return err
+	}
+
+	var ends []int64
+	for d := p; ; {
+		i := bytes.IndexByte(d, l.format.Delimiter)
+		if i < 0 {
+			break
+		}
+		ends = append(ends, offset+int64(len(p)-len(d)+i+1))
+		d = d[i+1:]
+	}
+
+	l.cl.Lock()
+	l.cursor = lineCursor{offset: offset + int64(len(p)), line: line + int64(len(ends))}
+	if len(ends) > 0 {
+		l.cursor.start = ends[len(ends)-1]
+	} else {
+		l.cursor.start = start
+	}
+	l.cl.Unlock()
+
+	if len(ends) == 0 {
+		return nil
+	}
+
+	sums, err := l.readSums(line, int64(len(ends)))
+	if err != nil {
+		return err
+	}
+
+	var corrupt []int64
+	for i, want := range sums {
+		var sum uint32
+		if start < offset {
+			// The start of the line came before this read
+			if sum, err = l.lineSum(start, offset); err != nil {
+				return err
+			}
+			sum = crc32.Update(sum, castagnoli, p[:ends[i]-offset])
+		} else {
+			sum = crc32.Checksum(p[start-offset:ends[i]-offset], castagnoli)
+		}
+		if sum != want {
+			corrupt = append(corrupt, line+int64(i))
+		}
+		start = ends[i]
+	}
+
+	if corrupt != nil {
+		return &ChecksumError{Lines: corrupt}
+	}
+	return nil
+}
+
+// lineAt returns the line containing offset and where it starts, from where the last verified
+// read ended if it is the same
+func (l *LineIndexedPipe) lineAt(offset int64) (line, start int64, err error) {
+	l.cl.Lock()
+	c := l.cursor
+	l.cl.Unlock()
+	if c.offset == offset {
+		return c.line, c.start, nil
+	}
+
+	l.wl.Lock()
+	defer l.wl.Unlock()
+
+	if err = l.load(); err != nil {
+		return
+	}
+
+	if offset >= l.lastIndex {
+		return l.lines, l.lastIndex, nil
+	}
+
+	i := sort.Search(int(l.lines), func(i int) bool {
+		if err != nil {
+			return true
+		}
+		var o int64
+		o, err = l.lineOffset(int64(i))
+		return o > offset
+	})
+	if err != nil {
+		return
+	}
+
+	line = int64(i) - 1
+	start, err = l.lineOffset(line)
+	return
+}
+
+// seekCursor has the next verified read from offset start in line
+func (l *LineIndexedPipe) seekCursor(line, offset int64) {
+	l.cl.Lock()
+	defer l.cl.Unlock()
+	l.cursor = lineCursor{offset: offset, line: line, start: offset}
+}
+
+// readSums reads the checksums of up to count lines from first, fewer if some lines have none
+func (l *LineIndexedPipe) readSums(first, count int64) (sums []uint32, err error) {
+	size, err := l.sums.Size()
+	if err != nil {
+		return nil, pipeError("size", "sums", err)
+	}
+	if have := size/sumSize - first; have < count {
+		count = have
+	}
+	if count <= 0 {
+		return nil, nil
+	}
+
+	sums = make([]uint32, count)
+	return sums, pipeError("read", "sums", readAt(l.sums, first*sumSize, sums))
+}
+
+// lineSum returns the checksum of the data between start and end
+func (l *LineIndexedPipe) lineSum(start, end int64) (uint32, error) {
+	h := crc32.New(castagnoli)
+	err := l.hashData(h, start, end)
+	return h.Sum32(), err
+}
+
+// hashData writes the data between start and end to h
+func (l *LineIndexedPipe) hashData(h hash.Hash, start, end int64) (err error) {
+	buf := make([]byte, 32*1024)
+	for start < end {
+		if int64(len(buf)) > end-start {
+			buf = buf[:end-start]
+		}
+		if _, err = l.readData(buf, start); err != nil {
+			return
+		}
+		h.Write(buf)
+		start += int64(len(buf))
+	}
+	return
+}
+
+// writeSum records the checksum of the line that has been completed, tail is the end of it that
+// has just been written and next is where the following line starts
+func (l *LineIndexedPipe) writeSum(line int64, tail []byte, next int64) (err error) {
+	if !l.sumsRead {
+		if err = l.loadSums(line); err != nil {
+			return
+		}
+	}
+
+	var sum uint32
+	if next-int64(len(tail)) == l.lastIndex {
+		sum = crc32.Checksum(tail, castagnoli)
+	} else if sum, err = l.lineSum(l.lastIndex, next); err != nil {
+		return
+	}
+
+	buf := make([]byte, sumSize)
+	binary.LittleEndian.PutUint32(buf, sum)
+	if _, err = l.sums.Append(buf); err != nil {
+		return pipeError("write", "sums", err)
+	}
+
+	return pipeError("sync", "sums", l.syncData(l.sums))
+}
+
+// loadSums has the checksums end at line, dropping any recorded for it by a failed index write
+// and adding those of lines written without them, fillBatch at a time
+func (l *LineIndexedPipe) loadSums(line int64) (err error) {
+	size, err := l.sums.Size()
+	if err != nil {
+		return pipeError("size", "sums", err)
+	}
+
+	have := size / sumSize
+	if have > line {
+		have = line
+	}
+	if size != have*sumSize {
+		if err = l.sums.Truncate(have * sumSize); err != nil {
+			return pipeError("truncate", "sums", err)
+		}
+	}
+
+	if have < line {
+		var start int64
+		if start, err = l.lineOffset(have); err != nil {
+			return
+		}
+		buf := make([]byte, 0, fillBatch*sumSize)
+		var sumErr error
+		err = l.scanData(start, l.lastIndex, func(end int64) bool {
+			var sum uint32
+			if sum, sumErr = l.lineSum(start, end); sumErr != nil {
+				return false
+			}
+			if buf = binary.LittleEndian.AppendUint32(buf, sum); len(buf) == cap(buf) {
+				if _, sumErr = l.sums.Append(buf); sumErr != nil {
+					sumErr = pipeError("write", "sums", sumErr)
+					return false
+				}
+				buf = buf[:0]
+			}
+			start = end
+			return true
+		})
+		if err != nil {
+			return
+		}
+		if sumErr != nil {
+			return sumErr
+		}
+		if len(buf) > 0 {
+			if _, err = l.sums.Append(buf); err != nil {
+				return pipeError("write", "sums", err)
+			}
+		}
+	}
+	l.sumsRead = true
+
+	return
+}
@@ -0,0 +1,178 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Ladbrokes/bufpipe"
+	"github.com/Ladbrokes/bufpipe/mock"
+)
+
+// corrupt flips the byte at offset in the named file
+func corrupt(t *testing.T, name string, offset int64) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal("Unable to open file", err)
+	}
+	defer f.Close()
+
+	b := make([]byte, 1)
+	if _, err = f.ReadAt(b, offset); err != nil {
+		t.Fatal("Unable to read file", err)
+	}
+	b[0] ^= 0x20
+	if _, err = f.WriteAt(b, offset); err != nil {
+		t.Fatal("Unable to write file", err)
+	}
+}
+
+func TestNoChecksumsPipe(t *testing.T) {
+	p := bufpipe.NewLineIndexedPipe(&mock.ReadWriteSeekable{}, &mock.ReadWriteSeekable{})
+
+	if lines, err := p.Verify(); lines != nil || err != bufpipe.ErrNoChecksums {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", nil, bufpipe.ErrNoChecksums, lines, err)
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testchecksums")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, index, sums := filepath.Join(dir, "data"), filepath.Join(dir, "index"), filepath.Join(dir, "sums")
+
+	p, err := bufpipe.OpenLineIndexedFilePipe(data, index, 0666, bufpipe.WithChecksumFile(sums))
+	if err != nil {
+		t.Fatal("Unable to create IndexedFile object", err)
+	}
+	defer p.Close()
+
+	// Lines are checked however they are split across writes
+	p.Write([]byte("Hello\nWor"))
+	p.Write([]byte("ld\nFoo\n"))
+
+	if lines, err := p.Verify(); lines != nil || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", nil, nil, lines, err)
+	}
+
+	corrupt(t, data, 7)
+
+	if lines, err := p.Verify(); !reflect.DeepEqual(lines, []int64{1}) || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", []int64{1}, nil, lines, err)
+	}
+
+	// Reads return the data with the damaged lines, lines are checked as they end
+	var got []byte
+	var bad []int64
+	b := make([]byte, 4)
+	for len(got) < 16 {
+		n, err := p.Read(b)
+		got = append(got, b[:n]...)
+		var cerr *bufpipe.ChecksumError
+		if errors.As(err, &cerr) {
+			bad = append(bad, cerr.Lines...)
+		} else if err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+	}
+	if string(got) != "Hello\nWOrld\nFoo\n" || !reflect.DeepEqual(bad, []int64{1}) {
+		t.Errorf("Expected [%q, %v] got [%q, %v]", "Hello\nWOrld\nFoo\n", []int64{1}, got, bad)
+	}
+
+	// Lines found by seeking are checked too
+	if err := p.SeekLine(1); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	b = make([]byte, 6)
+	var cerr *bufpipe.ChecksumError
+	if n, err := p.Read(b); n != 6 || !errors.As(err, &cerr) || !reflect.DeepEqual(cerr.Lines, []int64{1}) {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 6, []int64{1}, n, err)
+	}
+	if _, err := p.Seek(12, io.SeekStart); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if n, err := p.Read(b); n != 4 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 4, nil, n, err)
+	}
+
+	// Copying checks the lines as reading does
+	if _, err := p.Seek(0, io.SeekStart); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	w := &bytes.Buffer{}
+	if n, err := p.WriteTo(w); n != 16 || !errors.As(err, &cerr) || !reflect.DeepEqual(cerr.Lines, []int64{1}) {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 16, []int64{1}, n, err)
+	}
+	if w.String() != "Hello\nWOrld\nFoo\n" {
+		t.Errorf("Expected %q got %q", "Hello\nWOrld\nFoo\n", w.String())
+	}
+}
+
+func TestChecksumsAdded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testchecksums")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, index, sums := filepath.Join(dir, "data"), filepath.Join(dir, "index"), filepath.Join(dir, "sums")
+
+	p, err := bufpipe.OpenLineIndexedFilePipe(data, index, 0666, bufpipe.WithSparseIndex(bufpipe.IndexInterval{Lines: 2}))
+	if err != nil {
+		t.Fatal("Unable to create IndexedFile object", err)
+	}
+	p.Write([]byte("one\ntwo\nthree\nfour\n"))
+	p.Close()
+
+	p, err = bufpipe.OpenLineIndexedFilePipe(data, index, 0666, bufpipe.WithChecksumFile(sums))
+	if err != nil {
+		t.Fatal("Unable to reopen IndexedFile object", err)
+	}
+	defer p.Close()
+
+	// Lines written without checksums are not checked until the next write adds them
+	if lines, err := p.Verify(); lines != nil || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", nil, nil, lines, err)
+	}
+
+	p.Write([]byte("five\n"))
+	corrupt(t, data, 9)
+	corrupt(t, data, 20)
+
+	if lines, err := p.Verify(); !reflect.DeepEqual(lines, []int64{2, 4}) || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", []int64{2, 4}, nil, lines, err)
+	}
+}
+
+func TestChecksumsAddedBatches(t *testing.T) {
+	data, index, sums := bufpipe.NewMemoryStorage(), bufpipe.NewMemoryStorage(), bufpipe.NewMemoryStorage()
+
+	p, _ := bufpipe.OpenLineIndexedStoragePipe(data, index)
+	p.Write(bytes.Repeat([]byte("line\n"), 10000))
+
+	p, err := bufpipe.OpenLineIndexedStoragePipe(data, index, bufpipe.WithChecksums(sums))
+	if err != nil {
+		t.Fatal("Unable to reopen pipe", err)
+	}
+	defer p.Close()
+
+	p.Write([]byte("last\n"))
+
+	if size, err := sums.Size(); size != 10001*4 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 10001*4, nil, size, err)
+	}
+	if lines, err := p.Verify(); lines != nil || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", nil, nil, lines, err)
+	}
+}
@@ -0,0 +1,25 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+//go:build linux && (386 || amd64 || arm || arm64 || loong64 || riscv64 || s390x)
+// +build linux
+// +build 386 amd64 arm arm64 loong64 riscv64 s390x
+
+package bufpipe
+
+import (
+	"os"
+	"syscall"
+)
+
+// The FICLONE ioctl, _IOW(0x94, 9, int) on architectures using the generic ioctl encoding
+const ficlone = 0x40049409
+
+// reflink makes dst share the blocks of src until either is written to, where the file system
+// supports it
+func reflink(dst, src *os.File) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd()); errno != 0 {
+		return errno
+	}
+	return nil
+}
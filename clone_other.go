@@ -0,0 +1,18 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+//go:build !linux || !(386 || amd64 || arm || arm64 || loong64 || riscv64 || s390x)
+// +build !linux !386,!amd64,!arm,!arm64,!loong64,!riscv64,!s390x
+
+package bufpipe
+
+import (
+	"errors"
+	"os"
+)
+
+var errReflinkUnsupported = errors.New("reflink is not supported on this platform")
+
+func reflink(dst, src *os.File) error {
+	return errReflinkUnsupported
+}
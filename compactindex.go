@@ -0,0 +1,193 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// DefaultCompactBlock is the number of lines per block used by a compact index when none is given
+const DefaultCompactBlock = 128
+
+// NewCompactLineIndexedPipe returns a new line indexed pipe structure whose index stores lines
+// in blocks of the given number of lines. Each block starts with the little endian int64 offset
+// of its first line followed by the distance to each following line as a uvarint, which for
+// typical line lengths takes 1 or 2 bytes rather than 8.
+//
+// The position of each block is kept in memory, built by reading the whole index when it is
+// first used, so SeekLine only reads a single block. An existing index keeps the layout it was
+// created with.
+func NewCompactLineIndexedPipe(data, index io.ReadWriteSeeker, block int64) *LineIndexedPipe {
+	return newLineIndexedPipe(NewStorage(data), NewStorage(index), WithCompactIndex(block))
+}
+
+// compactIndex stores the offset of every line as deltas in fixed size blocks
+type compactIndex struct {
+	s     Storage
+	start int64
+	base  int64
+	block int64
+
+	loaded     bool
+	blocks     []int64 // position of each block in the index
+	lines      int64   // number of lines indexed
+	end        int64   // position following the last entry
+	lastOffset int64
+}
+
+func (c *compactIndex) add(line, offset int64) (err error) {
+	if err = c.load(); err != nil {
+		return
+	}
+
+	buf := make([]byte, binary.MaxVarintLen64)
+	var n int
+	if c.lines%c.block == 0 {
+		binary.LittleEndian.PutUint64(buf, uint64(offset-c.base))
+		n = int64Size
+	} else {
+		n = binary.PutUvarint(buf, uint64(offset-c.lastOffset))
+	}
+
+	if _, err = c.s.Append(buf[:n]); err != nil {
+		return
+	}
+
+	if c.lines%c.block == 0 {
+		c.blocks = append(c.blocks, c.end)
+	}
+	c.lines++
+	c.end += int64(n)
+	c.lastOffset = offset
+
+	return
+}
+
+func (c *compactIndex) find(line int64) (int64, int64, error) {
+	if err := c.load(); err != nil {
+		return 0, 0, err
+	}
+	if line < 0 || line >= c.lines {
+		return 0, 0, io.EOF
+	}
+
+	b := line / c.block
+	from, to := c.blocks[b], c.end
+	if b+1 < int64(len(c.blocks)) {
+		to = c.blocks[b+1]
+	}
+
+	buf := make([]byte, to-from)
+	if n, err := c.s.ReadAt(buf, from); n < len(buf) {
+		return 0, 0, err
+	}
+
+	offset := c.base + int64(binary.LittleEndian.Uint64(buf))
+	buf = buf[int64Size:]
+	for i := b * c.block; i < line; i++ {
+		delta, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return 0, 0, ErrIndexFormat
+		}
+		offset += int64(delta)
+		buf = buf[n:]
+	}
+
+	return line, offset, nil
+}
+
+func (c *compactIndex) last() (int64, int64, error) {
+	if err := c.load(); err != nil {
+		return 0, 0, err
+	}
+	if c.lines == 0 {
+		return -1, 0, nil
+	}
+	return c.lines - 1, c.lastOffset, nil
+}
+
+// load reads through the whole index to find the blocks, a partially written entry at the end
+// is dropped
+func (c *compactIndex) load() (err error) {
+	if c.loaded {
+		return
+	}
+
+	var size int64
+	if size, err = c.s.Size(); err != nil {
+		return
+	}
+
+	c.blocks, c.lines, c.end = nil, 0, c.start
+	if err = c.read(size); err != nil {
+		return
+	}
+
+	if c.end < size {
+		if err = c.s.Truncate(c.end); err != nil {
+			return
+		}
+	}
+
+	c.loaded = true
+
+	return nil
+}
+
+// reload reads on from the last entry read, rather than through the whole index again
+func (c *compactIndex) reload() (err error) {
+	if !c.loaded {
+		return c.load()
+	}
+
+	var size int64
+	if size, err = c.s.Size(); err != nil {
+		return
+	}
+	return c.read(size)
+}
+
+// read finds the blocks in the index from end up to size, a partially written entry at the end
+// is left unread
+func (c *compactIndex) read(size int64) (err error) {
+	if size <= c.end {
+		return nil
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(c.s, c.end, size-c.end))
+	fixed := make([]byte, int64Size)
+	for {
+		if c.lines%c.block == 0 {
+			if _, err = io.ReadFull(r, fixed); err != nil {
+				break
+			}
+			c.blocks = append(c.blocks, c.end)
+			c.lastOffset = c.base + int64(binary.LittleEndian.Uint64(fixed))
+			c.end += int64Size
+		} else {
+			var delta uint64
+			if delta, err = binary.ReadUvarint(r); err != nil {
+				break
+			}
+			c.lastOffset += int64(delta)
+			c.end += int64(uvarintSize(delta))
+		}
+		c.lines++
+	}
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return
+	}
+
+	return nil
+}
+
+func uvarintSize(v uint64) int {
+	n := 1
+	for ; v >= 0x80; v >>= 7 {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,72 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe_test
+
+import (
+	"io"
+	"testing"
+
+	"github.com/Ladbrokes/bufpipe"
+	"github.com/Ladbrokes/bufpipe/mock"
+)
+
+func TestCompactLineIndexedPipe(t *testing.T) {
+	data := &mock.ReadWriteSeekable{}
+	index := &mock.ReadWriteSeekable{}
+	p := bufpipe.NewCompactLineIndexedPipe(data, index, 16)
+
+	writeNumberedLines(t, p, 0, 100)
+
+	// Header, 7 blocks of 8 bytes and 93 single byte deltas
+	if n, err := p.IndexSize(); n != 32+7*8+93 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 32+7*8+93, nil, n, err)
+	}
+
+	if n, err := p.CountLines(); n != 100 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 100, nil, n, err)
+	}
+
+	testSeekLines(t, p, 100)
+
+	if err := p.SeekLine(100); err != io.EOF {
+		t.Errorf("Expected %v got %v", io.EOF, err)
+	}
+}
+
+func TestCompactReopenLineIndexedPipe(t *testing.T) {
+	data := &mock.ReadWriteSeekable{}
+	index := &mock.ReadWriteSeekable{}
+	p := bufpipe.NewCompactLineIndexedPipe(data, index, 0)
+
+	writeNumberedLines(t, p, 0, 200)
+
+	// A torn block start, the index is rebuilt from the data
+	torn := append([]byte{}, index.Bytes()[:32+8+127+4]...)
+	p = bufpipe.NewLineIndexedPipe(mock.NewReadWriteSeekable(data.Bytes()), mock.NewReadWriteSeekable(torn))
+
+	if n, err := p.CountLines(); n != 200 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 200, nil, n, err)
+	}
+
+	writeNumberedLines(t, p, 200, 300)
+
+	// Header, 3 blocks of 8 bytes and 297 single byte deltas
+	if n, err := p.IndexSize(); n != 32+3*8+297 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 32+3*8+297, nil, n, err)
+	}
+
+	testSeekLines(t, p, 300)
+}
+
+func TestCompactBadDeltaLineIndexedPipe(t *testing.T) {
+	index := &mock.ReadWriteSeekable{}
+	p := bufpipe.NewCompactLineIndexedPipe(&mock.ReadWriteSeekable{}, index, 0)
+	writeNumberedLines(t, p, 0, 2)
+
+	corrupt := append(append([]byte{}, index.Bytes()[:32+8]...), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f)
+	p = bufpipe.NewLineIndexedPipe(&mock.ReadWriteSeekable{}, mock.NewReadWriteSeekable(corrupt))
+	if _, err := p.CountLines(); err == nil {
+		t.Error("Expected an error loading an overflowing delta")
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrConsumerName is returned for consumer names that can not be used as a file name
+var ErrConsumerName = errors.New("invalid consumer name")
+
+// Consumer positions are committed to files named after the consumer in a directory named after
+// the data file with this suffix
+const consumersSuffix = ".consumers"
+
+// Consumer reads a pipe from its own position, independently of Read and of other consumers.
+// The position can be committed, and a consumer opened again with the same name resumes from
+// the position last committed. A Consumer is not safe for concurrent use.
+type Consumer struct {
+	pipe   *Pipe
+	delim  byte
+	name   string // file the position is committed to
+	line   int64
+	offset int64
+	stop   <-chan struct{} // closed to stop waiting for data, as the pipe is woken
+}
+
+// ConsumerInfo is the committed position of a consumer and how far it is behind the data
+type ConsumerInfo struct {
+	Name     string
+	Line     int64 // lines read
+	Offset   int64 // bytes read
+	Lag      int64 // bytes not yet read
+	LagLines int64 // lines not yet read, only for line indexed pipes
+}
+
+// OpenConsumer returns the named consumer of the pipe, resuming from its committed position.
+// Lines are ended by '\n'.
+func (l *FilePipe) OpenConsumer(name string) (*Consumer, error) {
+	return openConsumer(l.Pipe, '\n', l.name, name)
+}
+
+// Consumers returns the committed positions of the consumers of the pipe
+func (l *FilePipe) Consumers() ([]ConsumerInfo, error) {
+	return listConsumers(l.Pipe, l.name, nil)
+}
+
+// OpenConsumer returns the named consumer of the pipe, resuming from its committed position
+func (l *LineIndexedFilePipe) OpenConsumer(name string) (*Consumer, error) {
+	return openConsumer(l.Pipe, l.format.Delimiter, l.data, name)
+}
+
+// Consumers returns the committed positions of the consumers of the pipe
+func (l *LineIndexedFilePipe) Consumers() ([]ConsumerInfo, error) {
+	return listConsumers(l.Pipe, l.data, l.CountLines)
+}
+
+func openConsumer(p *Pipe, delim byte, data, name string) (*Consumer, error) {
+	if !validConsumerName(name) {
+		return nil, ErrConsumerName
+	}
+
+	dir := data + consumersSuffix
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	c := &Consumer{
+		pipe:  p,
+		delim: delim,
+		name:  filepath.Join(dir, name),
+	}
+
+	var err error
+	if c.line, c.offset, err = readConsumer(c.name); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func listConsumers(p *Pipe, data string, countLines func() (int64, error)) (consumers []ConsumerInfo, err error) {
+	files, err := ioutil.ReadDir(data + consumersSuffix)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	size, err := p.DataSize()
+	if err != nil {
+		return nil, err
+	}
+	var lines int64
+	if countLines != nil {
+		if lines, err = countLines(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, f := range files {
+		if !validConsumerName(f.Name()) {
+			continue
+		}
+
+		c := ConsumerInfo{Name: f.Name()}
+		if c.Line, c.Offset, err = readConsumer(filepath.Join(data+consumersSuffix, f.Name())); err != nil {
+			return nil, err
+		}
+		c.Lag = size - c.Offset
+		if countLines != nil {
+			c.LagLines = lines - c.Line
+		}
+		consumers = append(consumers, c)
+	}
+
+	return
+}
+
+// Read reads data from the position of the consumer, blocking until there is more if it has
+// read all there is. It returns the error that stopped the pipe once all the data is read.
+func (c *Consumer) Read(p []byte) (n int, err error) {
+	size, err := c.pipe.waitFor(c.offset, c.stop)
+	if err != nil {
+		return 0, err
+	}
+
+	if remaining := size - c.offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	if n, err = c.pipe.ReadAt(p, c.offset); err != nil {
+		return
+	}
+
+	c.offset += int64(n)
+	c.line += int64(bytes.Count(p[:n], []byte{c.delim}))
+	return
+}
+
+// ReadLine reads the next line including its delimiter, blocking until it is complete
+func (c *Consumer) ReadLine() (line []byte, err error) {
+	buf := make([]byte, 4096)
+	for offset := c.offset; ; {
+		var size int64
+		if size, err = c.pipe.waitFor(offset, c.stop); err != nil {
+			return nil, err
+		}
+
+		chunk := buf
+		if remaining := size - offset; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		if _, err = c.pipe.ReadAt(chunk, offset); err != nil {
+			return nil, err
+		}
+
+		if i := bytes.IndexByte(chunk, c.delim); i >= 0 {
+			line = append(line, chunk[:i+1]...)
+			c.offset = offset + int64(i) + 1
+			c.line++
+			return line, nil
+		}
+		line = append(line, chunk...)
+		offset += int64(len(chunk))
+	}
+}
+
+// Position returns the number of lines and bytes the consumer has read
+func (c *Consumer) Position() (line, offset int64) {
+	return c.line, c.offset
+}
+
+// Commit durably records the position of the consumer, to be resumed from when it is next opened
+func (c *Consumer) Commit() error {
+	tmp := c.name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+
+	err = binary.Write(f, binary.LittleEndian, [2]int64{c.line, c.offset})
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, c.name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// Make the rename durable, not all platforms can sync a directory
+	if d, err := os.Open(filepath.Dir(c.name)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
+
+// readConsumer reads the committed position of a consumer
+func readConsumer(name string) (line, offset int64, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var position [2]int64
+	if err = binary.Read(f, binary.LittleEndian, &position); err != nil {
+		return
+	}
+	return position[0], position[1], nil
+}
+
+func validConsumerName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`) &&
+		!strings.HasSuffix(name, ".tmp")
+}
+
+// waitFor waits until there is data after offset, returning the size of the data. Once the
+// pipe has stopped it returns the error it stopped with when there is no more data. It returns
+// io.ErrClosedPipe once stop is closed and the pipe woken, see wake.
+func (l *Pipe) waitFor(offset int64, stop <-chan struct{}) (size int64, err error) {
+	l.l.Lock()
+	defer l.l.Unlock()
+
+	for {
+		select {
+		case <-stop:
+			return 0, io.ErrClosedPipe
+		default:
+		}
+		if l.closed {
+			return 0, io.ErrClosedPipe
+		}
+		if l.size > offset {
+			return l.size, nil
+		}
+		if l.werr != nil {
+			return 0, l.werr
+		}
+		l.rwait.Wait()
+	}
+}
+
+// wake has those waiting for data check whether they have been stopped
+func (l *Pipe) wake() {
+	l.l.Lock()
+	defer l.l.Unlock()
+	l.rwait.Broadcast()
+}
@@ -0,0 +1,137 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Ladbrokes/bufpipe"
+)
+
+func TestConsumer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testconsumer")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, index := filepath.Join(dir, "data"), filepath.Join(dir, "index")
+	p, err := bufpipe.OpenLineIndexedFilePipe(data, index, 0666)
+	if err != nil {
+		t.Fatal("Unable to open pipe", err)
+	}
+	writeNumberedLines(t, p, 0, 10)
+
+	a, err := p.OpenConsumer("a")
+	if err != nil {
+		t.Fatal("Unable to open consumer", err)
+	}
+	for i := 0; i < 3; i++ {
+		a.ReadLine()
+	}
+	if err := a.Commit(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	a.ReadLine() // not committed
+
+	b, _ := p.OpenConsumer("b")
+	d := make([]byte, 14)
+	if n, err := io.ReadFull(b, d); err != nil || string(d[:n]) != "line 0\nline 1\n" {
+		t.Errorf("Expected [%v, %q] got [%v, %q]", nil, "line 0\nline 1\n", err, string(d[:n]))
+	}
+	b.Commit()
+
+	// Consumers read independently of the pipe
+	d = make([]byte, 7)
+	if n, err := p.Read(d); err != nil || string(d[:n]) != "line 0\n" {
+		t.Errorf("Expected [%v, %q] got [%v, %q]", nil, "line 0\n", err, string(d[:n]))
+	}
+
+	expect := []bufpipe.ConsumerInfo{
+		{Name: "a", Line: 3, Offset: 21, Lag: 49, LagLines: 7},
+		{Name: "b", Line: 2, Offset: 14, Lag: 56, LagLines: 8},
+	}
+	if consumers, err := p.Consumers(); err != nil || !reflect.DeepEqual(consumers, expect) {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", nil, expect, err, consumers)
+	}
+	p.Close()
+
+	// Consumers resume from their committed position
+	if p, err = bufpipe.OpenLineIndexedFilePipe(data, index, 0666); err != nil {
+		t.Fatal("Unable to open pipe", err)
+	}
+	defer p.Close()
+
+	if a, err = p.OpenConsumer("a"); err != nil {
+		t.Fatal("Unable to open consumer", err)
+	}
+	if line, offset := a.Position(); line != 3 || offset != 21 {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 3, 21, line, offset)
+	}
+	if line, err := a.ReadLine(); err != nil || string(line) != "line 3\n" {
+		t.Errorf("Expected [%v, %q] got [%v, %q]", nil, "line 3\n", err, string(line))
+	}
+
+	for _, name := range []string{"", ".", "..", "a/b", "a.tmp"} {
+		if _, err := p.OpenConsumer(name); err != bufpipe.ErrConsumerName {
+			t.Errorf("%q: expected %v got %v", name, bufpipe.ErrConsumerName, err)
+		}
+	}
+}
+
+func TestConsumerBlocking(t *testing.T) {
+	p, err := bufpipe.OpenTempFilePipe("")
+	if err != nil {
+		t.Fatal("Unable to create FilePipe", err)
+	}
+
+	c, err := p.OpenConsumer("c")
+	if err != nil {
+		t.Fatal("Unable to open consumer", err)
+	}
+
+	lines := make(chan string)
+	go func() {
+		for {
+			line, err := c.ReadLine()
+			if err != nil {
+				close(lines)
+				return
+			}
+			lines <- string(line)
+		}
+	}()
+
+	p.Write([]byte("hel"))
+	select {
+	case line := <-lines:
+		t.Errorf("Expected no line got %q", line)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	p.Write([]byte("lo\n"))
+	if line := <-lines; line != "hello\n" {
+		t.Errorf("Expected %q got %q", "hello\n", line)
+	}
+
+	c.Commit()
+	if consumers, err := p.Consumers(); err != nil || len(consumers) != 1 || consumers[0].Offset != 6 {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", nil, 6, err, consumers)
+	}
+
+	// Closing the pipe ends the consumer, and removes it with the temporary file
+	p.Close()
+	if _, ok := <-lines; ok {
+		t.Error("Expected the consumer to stop")
+	}
+	if _, err := os.Stat(p.Name() + ".consumers"); !os.IsNotExist(err) {
+		t.Errorf("Expected the consumers to be removed, got %v", err)
+	}
+}
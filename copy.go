@@ -0,0 +1,106 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe
+
+import (
+	"io"
+	"math"
+	"os"
+)
+
+// The size of the buffer used to copy to and from a pipe
+const copyBufferSize = 32 * 1024
+
+// WriteTo implements the io.WriterTo interface: it writes data from the pipe to w, blocking for
+// more until the pipe is closed or fails, when it returns the error Read would.
+//
+// When the data is stored in a file and w is a file or socket, the data is copied by the kernel
+// on platforms that support it rather than through a buffer.
+func (l *Pipe) WriteTo(w io.Writer) (n int64, err error) {
+	for {
+		offset, length, err := l.claim(math.MaxInt64)
+		if err != nil {
+			return n, err
+		}
+
+		c, rerr, werr := l.copyData(w, offset, length)
+		n += c
+		if werr != nil {
+			l.unclaim(offset+c, offset+length)
+		}
+		l.finish(rerr)
+
+		if rerr != nil {
+			return n, rerr
+		}
+		if werr != nil {
+			return n, werr
+		}
+	}
+}
+
+// ReadFrom implements the io.ReaderFrom interface: it writes what is read from r to the pipe
+// until r returns EOF
+func (l *Pipe) ReadFrom(r io.Reader) (n int64, err error) {
+	return readFrom(l.Write, r)
+}
+
+// ReadFrom implements the io.ReaderFrom interface: it writes what is read from r to the pipe
+// until r returns EOF, indexing the lines as Write does
+func (l *LineIndexedPipe) ReadFrom(r io.Reader) (n int64, err error) {
+	return readFrom(l.Write, r)
+}
+
+func readFrom(write func([]byte) (int, error), r io.Reader) (n int64, err error) {
+	buf := make([]byte, copyBufferSize)
+	for {
+		c, rerr := r.Read(buf)
+		if c > 0 {
+			c, err = write(buf[:c])
+			n += int64(c)
+			if err != nil {
+				return
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		} else if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// copyData copies length bytes of data from offset to w, returning the error reading the data
+// and the error writing to w separately
+func (l *Pipe) copyData(w io.Writer, offset, length int64) (n int64, rerr, werr error) {
+	if f, ok := l.data.(interface{ file() *os.File }); ok {
+		if c, handled, err := sendFile(w, f.file(), offset, length); handled {
+			return c, nil, err
+		}
+	}
+
+	size := int64(copyBufferSize)
+	if length < size {
+		size = length
+	}
+	buf := make([]byte, size)
+	for n < length {
+		chunk := buf
+		if length-n < int64(len(chunk)) {
+			chunk = chunk[:length-n]
+		}
+		if _, rerr = l.readData(chunk, offset+n); rerr != nil {
+			return
+		}
+		c, err := w.Write(chunk)
+		n += int64(c)
+		if err == nil && c < len(chunk) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			return n, nil, err
+		}
+	}
+	return
+}
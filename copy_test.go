@@ -0,0 +1,158 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Ladbrokes/bufpipe"
+)
+
+var errShortWriter = errors.New("short writer")
+
+// shortWriter accepts n bytes then fails
+type shortWriter struct {
+	n int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, errShortWriter
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+// copyTo copies p to w until the data is read by read, then closes p
+func copyTo(t *testing.T, p io.ReadWriteCloser, w io.Writer, read func() string) {
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.(io.WriterTo).WriteTo(w)
+		done <- err
+	}()
+
+	p.Write([]byte("hello "))
+	p.Write([]byte("world"))
+
+	if s := read(); s != "hello world" {
+		t.Errorf("Expected %q got %q", "hello world", s)
+	}
+
+	p.Close()
+	if err := <-done; err != io.ErrClosedPipe {
+		t.Errorf("Expected %v got %v", io.ErrClosedPipe, err)
+	}
+}
+
+func TestWriteToFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testwriteto")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, err := bufpipe.OpenTempFilePipe(dir)
+	if err != nil {
+		t.Fatal("Unable to create FilePipe", err)
+	}
+	f, err := os.Create(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal("Unable to create file", err)
+	}
+	defer f.Close()
+
+	copyTo(t, p, f, func() string {
+		for {
+			if d, _ := ioutil.ReadFile(f.Name()); len(d) >= 11 {
+				return string(d)
+			}
+		}
+	})
+}
+
+func TestWriteToSocket(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Unable to listen", err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("Unable to connect", err)
+	}
+	defer client.Close()
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal("Unable to accept", err)
+	}
+	defer server.Close()
+
+	for _, storage := range []string{"file", "memory"} {
+		var p io.ReadWriteCloser
+		if storage == "file" {
+			fp, err := bufpipe.OpenTempFilePipe("")
+			if err != nil {
+				t.Fatal("Unable to create FilePipe", err)
+			}
+			p = fp
+		} else {
+			p = bufpipe.NewStoragePipe(bufpipe.NewMemoryStorage())
+		}
+
+		copyTo(t, p, server, func() string {
+			d := make([]byte, 11)
+			if _, err := io.ReadFull(client, d); err != nil {
+				t.Errorf("%s: unexpected error %v", storage, err)
+			}
+			return string(d)
+		})
+	}
+}
+
+func TestWriteToFailure(t *testing.T) {
+	p := bufpipe.NewStoragePipe(bufpipe.NewMemoryStorage())
+	p.Write([]byte("hello world"))
+
+	if n, err := p.WriteTo(&shortWriter{n: 6}); err != errShortWriter || n != 6 {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", errShortWriter, 6, err, n)
+	}
+
+	// What was not written can still be read
+	d := make([]byte, 11)
+	if n, err := p.Read(d); err != nil || string(d[:n]) != "world" {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", nil, "world", err, string(d[:n]))
+	}
+}
+
+func TestReadFrom(t *testing.T) {
+	p := bufpipe.NewStoragePipe(bufpipe.NewMemoryStorage())
+	if n, err := p.ReadFrom(strings.NewReader("hello world")); err != nil || n != 11 {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", nil, 11, err, n)
+	}
+	if s, err := p.DataSize(); err != nil || s != 11 {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", nil, 11, err, s)
+	}
+
+	lp, err := bufpipe.OpenLineIndexedStoragePipe(bufpipe.NewMemoryStorage(), bufpipe.NewMemoryStorage())
+	if err != nil {
+		t.Fatal("Unable to create LineIndexedPipe", err)
+	}
+	text := strings.Repeat("a line of text\n", 5000)
+	if n, err := lp.ReadFrom(strings.NewReader(text)); err != nil || n != int64(len(text)) {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", nil, len(text), err, n)
+	}
+	if lines, err := lp.CountLines(); err != nil || lines != 5000 {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", nil, 5000, err, lines)
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe
+
+import (
+	"io"
+)
+
+// PipeError records a failure of one of the Storages behind a pipe and what was being done.
+//
+// Op is one of "size", "read", "write", "sync", "truncate", "load" or "close", where load is
+// reading the existing state of an index when it is first used. Side is the Storage that failed,
+// one of "data", "index", "times", "sums", "chain" or "tree".
+type PipeError struct {
+	Op   string
+	Side string
+	Err  error
+}
+
+func (e *PipeError) Error() string {
+	return "bufpipe: " + e.Op + " " + e.Side + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *PipeError) Unwrap() error {
+	return e.Err
+}
+
+// pipeError wraps err in a PipeError, io.EOF and errors that are already wrapped are returned as is
+func pipeError(op, side string, err error) error {
+	switch err.(type) {
+	case nil, *PipeError:
+		return err
+	}
+	if err == io.EOF {
+		return err
+	}
+	return &PipeError{Op: op, Side: side, Err: err}
+}
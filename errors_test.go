@@ -0,0 +1,145 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/Ladbrokes/bufpipe"
+	"github.com/Ladbrokes/bufpipe/mock"
+)
+
+func TestPipeError(t *testing.T) {
+	data := &mock.ReadWriteSeekable{}
+	index := &mock.SyncReadWriteSeekable{ReadWriteSeekable: &mock.ReadWriteSeekable{}}
+	times := &mock.ReadWriteSeekable{}
+
+	for _, test := range []struct {
+		fail   func()
+		op     string
+		side   string
+		expect error
+	}{
+		{func() { data.SeekFunc = unseekableFunc }, "write", "data", errUnseekable},
+		{func() { index.WriteFunc = unwriteableFunc }, "write", "index", io.ErrUnexpectedEOF},
+		{func() { index.SyncFunc = func() error { return io.ErrUnexpectedEOF } }, "sync", "index", io.ErrUnexpectedEOF},
+		{func() { times.WriteFunc = unwriteableFunc }, "write", "times", io.ErrUnexpectedEOF},
+	} {
+		data.Reset()
+		index.Reset()
+		index.SyncFunc = nil
+		times.Reset()
+		p := bufpipe.NewLineTimeIndexedPipe(data, index, times)
+		p.CountLines()
+
+		test.fail()
+		_, err := p.Write([]byte("Hello\n"))
+
+		var perr *bufpipe.PipeError
+		if !errors.As(err, &perr) || perr.Op != test.op || perr.Side != test.side || perr.Err != test.expect {
+			t.Errorf("Expected [%v, %v, %v] got %v", test.op, test.side, test.expect, err)
+			continue
+		}
+
+		if expect := "bufpipe: " + test.op + " " + test.side + ": " + test.expect.Error(); err.Error() != expect {
+			t.Errorf("Expected %v got %v", expect, err)
+		}
+	}
+}
+
+func TestRecoverPipe(t *testing.T) {
+	buf := &mock.ReadWriteSeekable{}
+	p := bufpipe.NewPipe(buf)
+	p.Write([]byte("Hello "))
+
+	buf.SeekFunc = unseekableFunc
+	if _, err := p.Write([]byte("World")); !errors.Is(err, errUnseekable) {
+		t.Errorf("Expected %v got %v", errUnseekable, err)
+	}
+
+	// Still failing
+	if err := p.Recover(); !errors.Is(err, errUnseekable) {
+		t.Errorf("Expected %v got %v", errUnseekable, err)
+	}
+	if n, err := p.Write([]byte("World")); n != 0 || err != io.ErrClosedPipe {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 0, io.ErrClosedPipe, n, err)
+	}
+
+	buf.SeekFunc = nil
+	if err := p.Recover(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if n, err := p.Write([]byte("World")); n != 5 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 5, nil, n, err)
+	}
+
+	d := make([]byte, 11)
+	if n, err := io.ReadFull(p, d); n != 11 || err != nil || string(d) != "Hello World" {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", "Hello World", nil, string(d[:n]), err)
+	}
+
+	p.Close()
+	if err := p.Recover(); err != io.ErrClosedPipe {
+		t.Errorf("Expected %v got %v", io.ErrClosedPipe, err)
+	}
+}
+
+func TestRecoverReadPipe(t *testing.T) {
+	buf := &mock.ReadWriteSeekable{}
+	p := bufpipe.NewPipe(buf)
+	p.Write([]byte("01234567"))
+
+	errInterrupted := errors.New("interrupted")
+	buf.ReadFunc = func(*mock.ReadWriteSeekable, []byte) (int, error) {
+		return 0, errInterrupted
+	}
+	d := make([]byte, 4)
+	if n, err := p.Read(d); n != 0 || !errors.Is(err, errInterrupted) {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 0, errInterrupted, n, err)
+	}
+
+	// The failed read is read again once recovered
+	buf.ReadFunc = nil
+	if err := p.Recover(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if n, err := io.ReadFull(p, d); n != 4 || err != nil || string(d) != "0123" {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", "0123", nil, string(d[:n]), err)
+	}
+}
+
+func TestRecoverLineIndexedPipe(t *testing.T) {
+	index := &mock.ReadWriteSeekable{}
+	p := bufpipe.NewLineIndexedPipe(&mock.ReadWriteSeekable{}, index)
+	p.Write([]byte("Hello\n"))
+
+	// The data is written but not the index
+	index.WriteFunc = unwriteableFunc
+	if _, err := p.Write([]byte("World\n")); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected %v got %v", io.ErrUnexpectedEOF, err)
+	}
+
+	index.WriteFunc = nil
+	if err := p.Recover(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	if n, err := p.CountLines(); n != 2 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 2, nil, n, err)
+	}
+
+	p.Write([]byte("Again\n"))
+	p.SeekLine(1)
+	if d, err := ioutil.ReadAll(io.LimitReader(p, 12)); string(d) != "World\nAgain\n" || err != nil {
+		t.Errorf("Expected [%q, %v] got [%q, %v]", "World\nAgain\n", nil, d, err)
+	}
+
+	p.Close()
+	if err := p.Recover(); err != io.ErrClosedPipe {
+		t.Errorf("Expected %v got %v", io.ErrClosedPipe, err)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+)
+
+// FilePipe Pipe around a File
+type FilePipe struct {
+	*Pipe
+	name   string
+	remove bool // remove the file on close
+}
+
+// NewFilePipe will create and return a FilePipe based around the given filename.
+// The file will be created if required with the given permissions, if the file already exists
+// it will be opened for appending.
+func NewFilePipe(name string, perm os.FileMode) (*FilePipe, error) {
+	return OpenFilePipe(name, perm)
+}
+
+// NewTempFilePipe will create and return a FilePipe based around a new temporary file in dir,
+// or the default directory for temporary files if dir is empty. The file is removed by Close.
+func NewTempFilePipe(dir string) (*FilePipe, error) {
+	return OpenTempFilePipe(dir)
+}
+
+// OpenFilePipe is NewFilePipe configured by opts. Unless opened read only, the file is locked
+// against other writers until Close and ErrLocked is returned if another writer has it open.
+func OpenFilePipe(name string, perm os.FileMode, opts ...Option) (*FilePipe, error) {
+	o := newOptions(opts)
+
+	if o.follow {
+		o.readOnly = true
+	}
+	flag := os.O_APPEND | os.O_CREATE | os.O_RDWR
+	if o.readOnly {
+		flag = os.O_RDONLY
+	}
+
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if !o.readOnly {
+		if err = lockFile(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	l, err := newFilePipe(f, false, o)
+	if err != nil {
+		return nil, err
+	}
+	if o.follow {
+		l.follow([]string{name}, o.poll, l.refresh)
+	}
+
+	return l, nil
+}
+
+// OpenTempFilePipe is NewTempFilePipe configured by opts
+func OpenTempFilePipe(dir string, opts ...Option) (*FilePipe, error) {
+	f, err := ioutil.TempFile(dir, "bufpipe")
+	if err != nil {
+		return nil, err
+	}
+
+	o := newOptions(opts)
+	o.follow, o.readOnly = false, false
+	return newFilePipe(f, true, o)
+}
+
+func newFilePipe(f *os.File, remove bool, o *options) (*FilePipe, error) {
+	p, err := openPipe(NewFileStorage(f), o)
+	if err != nil {
+		f.Close()
+		if remove {
+			os.Remove(f.Name())
+		}
+		return nil, err
+	}
+
+	return &FilePipe{
+		Pipe:   p,
+		name:   f.Name(),
+		remove: remove,
+	}, nil
+}
+
+// Name returns the name of the file
+func (l *FilePipe) Name() string {
+	return l.name
+}
+
+// Close closes the Pipe, rendering it unusable for I/O, and removes the file and its consumers
+// if it is temporary.
+// It returns every error closing or removing the file, if any.
+func (l *FilePipe) Close() error {
+	err := l.Pipe.Close()
+	if !l.remove {
+		return err
+	}
+
+	return errors.Join(err, os.Remove(l.name), os.RemoveAll(l.name+consumersSuffix))
+}
@@ -0,0 +1,108 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Ladbrokes/bufpipe"
+)
+
+func TestFilePipe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testfilepipe")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "data")
+	p, err := bufpipe.NewFilePipe(name, 0666)
+	if err != nil {
+		t.Fatal("Unable to create FilePipe", err)
+	}
+	if p.Name() != name {
+		t.Errorf("Expected %v got %v", name, p.Name())
+	}
+
+	p.Write([]byte("hello"))
+	if err := p.Close(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	if n, err := p.Write([]byte("hello")); n != 0 || err != io.ErrClosedPipe {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 0, io.ErrClosedPipe, n, err)
+	}
+
+	// Closing again reports the file is already closed
+	if err := p.Close(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Expected %v got %v", os.ErrClosed, err)
+	}
+
+	// Reopen existing
+	if p, err = bufpipe.NewFilePipe(name, 0666); err != nil {
+		t.Fatal("Unable to create FilePipe", err)
+	}
+	p.Write([]byte(" world"))
+
+	d := make([]byte, 11)
+	if n, err := io.ReadFull(p, d); n != 11 || err != nil || string(d) != "hello world" {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", "hello world", nil, string(d[:n]), err)
+	}
+	p.Close()
+
+	if _, err := os.Stat(name); err != nil {
+		t.Errorf("Expected the file to remain, got %v", err)
+	}
+
+	// Unopenable
+	if _, err = bufpipe.NewFilePipe(dir, 0666); err == nil {
+		t.Error("Expected an error opening a directory")
+	}
+}
+
+func TestTempFilePipe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testfilepipe")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, err := bufpipe.NewTempFilePipe(dir)
+	if err != nil {
+		t.Fatal("Unable to create FilePipe", err)
+	}
+	if filepath.Dir(p.Name()) != dir {
+		t.Errorf("Expected %v got %v", dir, filepath.Dir(p.Name()))
+	}
+
+	p.Write([]byte("hello"))
+	if err := p.Close(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	if _, err := os.Stat(p.Name()); !os.IsNotExist(err) {
+		t.Errorf("Expected the file to be removed, got %v", err)
+	}
+
+	if _, err = bufpipe.NewTempFilePipe(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("Expected not exist got %v", err)
+	}
+}
+
+func TestClosePipe(t *testing.T) {
+	var p io.ReadWriteCloser = bufpipe.NewStoragePipe(bufpipe.NewMemoryStorage())
+
+	if err := p.Close(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	if n, err := p.Read(make([]byte, 1)); n != 0 || err != io.ErrClosedPipe {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 0, io.ErrClosedPipe, n, err)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// DefaultFollowInterval is how often followed files are checked for changes the operating
+// system does not report
+const DefaultFollowInterval = time.Second
+
+// WithFollow opens a file pipe read only to follow its files as another process writes them,
+// as tail -F does. Readers are woken as the data grows and new lines are found as they are
+// written. If the data file is replaced, such as by log rotation, the pipe reads the new files
+// from the start. Changes are noticed with inotify on Linux, and by checking the files every
+// interval, DefaultFollowInterval if 0.
+//
+// It only applies to pipes opened by name.
+func WithFollow(interval time.Duration) Option {
+	return func(o *options) {
+		o.follow = true
+		o.poll = interval
+	}
+}
+
+// follow calls refresh whenever the named files change, and every interval, until the pipe is
+// closed
+func (l *Pipe) follow(names []string, interval time.Duration, refresh func() error) {
+	if interval <= 0 {
+		interval = DefaultFollowInterval
+	}
+
+	changed := make(chan struct{}, 1)
+	stop := watch(names, changed)
+
+	go func() {
+		defer stop()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-l.done:
+				return
+			case <-changed:
+			case <-ticker.C:
+			}
+
+			if err := refresh(); err != nil && err != io.ErrClosedPipe {
+				l.logf("bufpipe: following failed: %v", err)
+			}
+		}
+	}()
+}
+
+// grow reads the size of the data again, waking readers if it has grown. The caller must
+// hold wl.
+func (l *Pipe) grow() error {
+	if err := l.resize(); err != nil {
+		return err
+	}
+
+	l.l.Lock()
+	l.rwait.Broadcast()
+	l.l.Unlock()
+
+	return nil
+}
+
+// replace moves the pipe to the start of new data once reads of the old data have finished,
+// closing the old data. The caller must hold wl.
+func (l *Pipe) replace(data Storage) error {
+	size, err := data.Size()
+	if err != nil {
+		data.Close()
+		return pipeError("size", "data", err)
+	}
+
+	l.l.Lock()
+	if l.closed {
+		l.l.Unlock()
+		data.Close()
+		return io.ErrClosedPipe
+	}
+	for l.reading > 0 {
+		l.dropping = true
+		l.rwait.Wait()
+	}
+	l.dropping = false
+
+	old := l.data
+	l.data, l.size, l.readIndex = data, size, 0
+	l.release, _ = data.(Releaser)
+	l.rwait.Broadcast()
+	l.l.Unlock()
+
+	return pipeError("close", "data", old.Close())
+}
+
+// rotated opens the named file if it has replaced the file of s
+func rotated(name string, s Storage) (*os.File, error) {
+	f, ok := s.(interface{ file() *os.File })
+	if !ok {
+		return nil, nil
+	}
+
+	current, err := f.file().Stat()
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		// Moved away and not yet replaced
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if os.SameFile(current, info) {
+		return nil, nil
+	}
+
+	return os.Open(name)
+}
+
+// refresh picks up what another process has written to the file, moving to a new file of the
+// same name if it has been replaced
+func (l *FilePipe) refresh() error {
+	l.wl.Lock()
+	defer l.wl.Unlock()
+
+	f, err := rotated(l.name, l.data)
+	if err != nil {
+		return err
+	}
+	if f != nil {
+		if err = l.replace(newReadOnlyStorage(NewFileStorage(f))); err != nil {
+			return err
+		}
+	}
+
+	return l.grow()
+}
+
+// refresh picks up the data and index another process has written, moving to new files of the
+// same names if the data has been replaced
+func (l *LineIndexedFilePipe) refresh() error {
+	l.wl.Lock()
+	defer l.wl.Unlock()
+
+	data, err := rotated(l.data, l.Pipe.data)
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		if err = l.reopen(data); err != nil {
+			return err
+		}
+	}
+
+	if err = l.grow(); err != nil {
+		return err
+	}
+
+	return l.reload()
+}
+
+// reopen moves the pipe to new files replacing those it was opened with. The caller must hold wl.
+func (l *LineIndexedFilePipe) reopen(data *os.File) error {
+	files := []*os.File{data}
+	closeAll := func() {
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}
+	for _, name := range []string{l.index, l.times, l.sums, l.chain, l.tree} {
+		var f *os.File
+		if name != "" {
+			var err error
+			if f, err = os.Open(name); err != nil {
+				closeAll()
+				return err
+			}
+		}
+		files = append(files, f)
+	}
+
+	if err := l.replace(newReadOnlyStorage(newPreallocatedFile(data, files[1], 0))); err != nil {
+		files[0] = nil
+		closeAll()
+		return err
+	}
+
+	index, times, sums, chain, tree := files[1], files[2], files[3], files[4], files[5]
+	l.LineIndexedPipe.index.Close()
+	l.LineIndexedPipe.index = newReadOnlyStorage(newPreallocatedFile(index, index, indexHeaderSize))
+	if times != nil {
+		l.LineIndexedPipe.times.Close()
+		l.LineIndexedPipe.times = newReadOnlyStorage(NewFileStorage(times))
+	}
+	if sums != nil {
+		l.LineIndexedPipe.sums.Close()
+		l.LineIndexedPipe.sums = newReadOnlyStorage(NewFileStorage(sums))
+		l.seekCursor(0, 0)
+	}
+	if chain != nil {
+		l.LineIndexedPipe.chain.Close()
+		l.LineIndexedPipe.chain = newReadOnlyStorage(NewFileStorage(chain))
+	}
+	if tree != nil {
+		l.LineIndexedPipe.tree.Close()
+		l.LineIndexedPipe.tree = newReadOnlyStorage(NewFileStorage(tree))
+	}
+	l.unload()
+
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package bufpipe
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const inotifyMask = syscall.IN_MODIFY | syscall.IN_ATTRIB | syscall.IN_CLOSE_WRITE | syscall.IN_CREATE |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// watch signals changed when the named files change, until stop is called. The directories are
+// watched so that files created to replace them are noticed. Nothing is signalled if inotify
+// is not available.
+func watch(names []string, changed chan<- struct{}) (stop func()) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return func() {}
+	}
+	// Non blocking so that reads wait in the runtime poller and end when the file is closed
+	f := os.NewFile(uintptr(fd), "inotify")
+
+	watched, bases := make(map[string]bool), make(map[string]bool)
+	for _, name := range names {
+		dir := filepath.Dir(name)
+		if !watched[dir] {
+			if _, err := syscall.InotifyAddWatch(fd, dir, inotifyMask); err != nil {
+				f.Close()
+				return func() {}
+			}
+			watched[dir] = true
+		}
+		bases[filepath.Base(name)] = true
+	}
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				return
+			}
+
+			notify := false
+			for events := buf[:n]; len(events) >= syscall.SizeofInotifyEvent; {
+				mask := binary.NativeEndian.Uint32(events[4:])
+				length := int(binary.NativeEndian.Uint32(events[12:]))
+				name := events[syscall.SizeofInotifyEvent:]
+				if length < len(name) {
+					name = name[:length]
+				}
+				events = events[syscall.SizeofInotifyEvent+len(name):]
+
+				if mask&syscall.IN_Q_OVERFLOW != 0 || bases[strings.TrimRight(string(name), "\x00")] {
+					notify = true
+				}
+			}
+
+			if notify {
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	return func() {
+		f.Close()
+	}
+}
@@ -0,0 +1,12 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package bufpipe
+
+// watch does nothing, changes are found by checking the files every interval
+func watch(names []string, changed chan<- struct{}) (stop func()) {
+	return func() {}
+}
@@ -0,0 +1,185 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe_test
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Ladbrokes/bufpipe"
+)
+
+// readWithin reads len(expect) bytes from r, failing if it takes too long
+func readWithin(t *testing.T, r io.Reader, expect string) {
+	done := make(chan string, 1)
+	go func() {
+		d := make([]byte, len(expect))
+		n, _ := io.ReadFull(r, d)
+		done <- string(d[:n])
+	}()
+
+	select {
+	case got := <-done:
+		if got != expect {
+			t.Errorf("Expected %q got %q", expect, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out reading %q", expect)
+	}
+}
+
+func TestFollowFilePipe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testfollow")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "log")
+	w, err := os.Create(name)
+	if err != nil {
+		t.Fatal("Unable to create file", err)
+	}
+	w.WriteString("first\n")
+
+	// A long interval, changes are noticed by inotify where it is available
+	interval := time.Hour
+	if _, err := os.Stat("/proc/sys/fs/inotify"); err != nil {
+		interval = 10 * time.Millisecond
+	}
+
+	p, err := bufpipe.OpenFilePipe(name, 0666, bufpipe.WithFollow(interval))
+	if err != nil {
+		t.Fatal("Unable to open pipe", err)
+	}
+	defer p.Close()
+
+	if _, err := p.Write([]byte("no")); err != bufpipe.ErrReadOnly {
+		t.Errorf("Expected %v got %v", bufpipe.ErrReadOnly, err)
+	}
+
+	readWithin(t, p, "first\n")
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		w.WriteString("second\n")
+	}()
+	readWithin(t, p, "second\n")
+
+	// Rotated files are read from the start
+	w.Close()
+	if err := os.Rename(name, name+".1"); err != nil {
+		t.Fatal("Unable to rename", err)
+	}
+	if err := ioutil.WriteFile(name, []byte("rotated\n"), 0666); err != nil {
+		t.Fatal("Unable to write file", err)
+	}
+	readWithin(t, p, "rotated\n")
+}
+
+func TestFollowLineIndexedFilePipe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testfollow")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, index := filepath.Join(dir, "data"), filepath.Join(dir, "index")
+	for _, name := range []string{data, index} {
+		ioutil.WriteFile(name, nil, 0666)
+	}
+
+	// Followed before the writer has created the index
+	f, err := bufpipe.OpenLineIndexedFilePipe(data, index, 0666, bufpipe.WithFollow(10*time.Millisecond))
+	if err != nil {
+		t.Fatal("Unable to open follower", err)
+	}
+	defer f.Close()
+	if lines, err := f.CountLines(); err != nil || lines != 0 {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", nil, 0, err, lines)
+	}
+
+	w, err := bufpipe.OpenLineIndexedFilePipe(data, index, 0666)
+	if err != nil {
+		t.Fatal("Unable to open writer", err)
+	}
+	defer w.Close()
+	writeNumberedLines(t, w, 0, 5)
+
+	readWithin(t, f, "line 0\n")
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if lines, _ := f.CountLines(); lines == 5 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for lines to be indexed")
+		}
+	}
+
+	if err := f.SeekLine(3); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Scan()
+	if scanner.Text() != "line 3" {
+		t.Errorf("Expected %v got %v", "line 3", scanner.Text())
+	}
+
+	if _, err := f.Write([]byte("no\n")); err != bufpipe.ErrReadOnly {
+		t.Errorf("Expected %v got %v", bufpipe.ErrReadOnly, err)
+	}
+
+	// Nothing was written to the files by the follower
+	if n := fileSize(t, index); n != 32+5*8 {
+		t.Errorf("Expected %v got %v", 32+5*8, n)
+	}
+}
+
+func TestFollowReloadIndexFilePipe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testfollow")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, index := filepath.Join(dir, "data"), filepath.Join(dir, "index")
+
+	for _, every := range []bufpipe.Option{bufpipe.WithCompactIndex(4), bufpipe.WithSparseIndex(bufpipe.IndexInterval{Lines: 4})} {
+		os.Remove(data)
+		os.Remove(index)
+
+		w, err := bufpipe.OpenLineIndexedFilePipe(data, index, 0666, every)
+		if err != nil {
+			t.Fatal("Unable to open writer", err)
+		}
+		writeNumberedLines(t, w, 0, 5)
+
+		f, err := bufpipe.OpenLineIndexedFilePipe(data, index, 0666, bufpipe.WithFollow(10*time.Millisecond))
+		if err != nil {
+			t.Fatal("Unable to open follower", err)
+		}
+
+		// Lines added to the index after it was read are found
+		for from := 5; from < 30; from += 5 {
+			writeNumberedLines(t, w, from, from+5)
+			for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+				if lines, _ := f.CountLines(); lines == int64(from+5) {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("Timed out waiting for lines to be indexed")
+				}
+			}
+		}
+		testSeekLines(t, f.LineIndexedPipe, 30)
+
+		f.Close()
+		w.Close()
+	}
+}
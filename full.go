@@ -0,0 +1,154 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe
+
+import (
+	"errors"
+	"io"
+	"syscall"
+	"time"
+)
+
+// FullPolicy decides what a write does when the Storage is full, that is it fails with
+// ErrStorageFull or ENOSPC
+type FullPolicy int
+
+const (
+	// FullFail stops the pipe as any other error does, the default
+	FullFail FullPolicy = iota
+	// FullReject fails only the write, and the pipe can still be read and written to. A Pipe
+	// keeps nothing of the write. A LineIndexedPipe keeps the complete lines written before the
+	// one that did not fit, counted in the n returned, and nothing of that line or what follows.
+	FullReject
+	// FullBlock retries the write with an increasing delay until there is room or the pipe is
+	// closed. Other writes can go ahead of it meanwhile, though not part way through a line
+	// written to a LineIndexedPipe.
+	FullBlock
+	// FullDropOldest discards the oldest data not yet read to make room, moving readers past it.
+	// A LineIndexedPipe discards whole lines, moving readers to the start of the next.
+	// It needs Storage that can discard data, see Releaser, otherwise the write is rejected.
+	FullDropOldest
+)
+
+// The delay between retries when blocking on a full Storage
+var (
+	fullRetryMin = 10 * time.Millisecond
+	fullRetryMax = time.Second
+)
+
+// WithFullPolicy sets what a write does when the Storage is full. A write past the limit set
+// by WithLimit is always rejected.
+func WithFullPolicy(policy FullPolicy) Option {
+	return func(o *options) {
+		o.full = policy
+	}
+}
+
+func isFull(err error) bool {
+	return errors.Is(err, ErrStorageFull) || errors.Is(err, syscall.ENOSPC)
+}
+
+// stops reports whether err from a write stops the pipe, a full Storage only does so with FullFail
+func (l *Pipe) stops(err error) bool {
+	return err != nil && (l.full == FullFail || !isFull(err))
+}
+
+// retryFull calls write of the n bytes left to write, applying the full policy if it fails
+// because the Storage is full. rollback must undo what the failed write left in the Storage, if
+// it can not the error it returns is returned instead. The caller must hold wl, which is
+// released while blocked.
+func (l *Pipe) retryFull(n int, write, rollback func() error) (err error) {
+	delay, step := fullRetryMin, int64(n)
+	if step < 1 {
+		step = 1
+	}
+	for {
+		if err = write(); err == nil || l.stops(err) {
+			return
+		}
+
+		if rerr := rollback(); rerr != nil {
+			return rerr
+		}
+
+		switch l.full {
+		case FullBlock:
+			// Other writers and those waiting on wl, such as SeekLine, go ahead while blocked
+			l.wl.Unlock()
+			select {
+			case <-l.done:
+			case <-time.After(delay):
+			}
+			l.wl.Lock()
+
+			if err = l.writable(); err != nil {
+				return
+			}
+			select {
+			case <-l.done:
+				return io.ErrClosedPipe
+			default:
+			}
+			if err = l.fits(n); err != nil {
+				return
+			}
+			if delay *= 2; delay > fullRetryMax {
+				delay = fullRetryMax
+			}
+		case FullDropOldest:
+			if !l.drop(step) {
+				return
+			}
+			step *= 2
+		default:
+			return
+		}
+	}
+}
+
+// drop moves the read position up to step bytes past the oldest data not yet read, then on to
+// the next boundary, and releases the data before it once no reads are in progress. It reports
+// whether anything was dropped.
+func (l *Pipe) drop(step int64) bool {
+	l.l.Lock()
+	from, size := l.readIndex, l.size
+	l.l.Unlock()
+
+	if l.release == nil || from >= size {
+		return false
+	}
+
+	to := from + step
+	if to > size {
+		to = size
+	}
+	if l.boundary != nil {
+		var err error
+		if to, err = l.boundary(to); err != nil {
+			l.logf("bufpipe: storage full, unable to drop data: %v", err)
+			return false
+		}
+	}
+
+	l.l.Lock()
+	defer l.l.Unlock()
+
+	// Readers may have moved on while unlocked
+	if to <= l.readIndex {
+		return l.readIndex > from
+	}
+	from, l.readIndex = l.readIndex, to
+	l.logf("bufpipe: storage full, dropped %d bytes", l.readIndex-from)
+
+	// Reads in progress may be of the data being released
+	for l.reading > 0 {
+		l.dropping = true
+		l.rwait.Wait()
+	}
+	l.dropping = false
+
+	l.release.Release(l.readIndex)
+
+	return true
+}
@@ -0,0 +1,300 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Ladbrokes/bufpipe"
+	"github.com/Ladbrokes/bufpipe/mock"
+)
+
+// fullAfter fails writes with ENOSPC after writing at most n bytes, for the next times writes
+func fullAfter(n, times int) func(rws *mock.ReadWriteSeekable, b []byte) (int, error) {
+	return func(rws *mock.ReadWriteSeekable, b []byte) (int, error) {
+		f := rws.WriteFunc
+		defer func() { rws.WriteFunc = f }()
+		rws.WriteFunc = nil
+
+		if times--; times < 0 {
+			return rws.Write(b)
+		}
+		if len(b) > n {
+			b = b[:n]
+		}
+		w, _ := rws.Write(b)
+		return w, syscall.ENOSPC
+	}
+}
+
+func TestFullFailPipe(t *testing.T) {
+	p := bufpipe.NewStoragePipe(bufpipe.NewBufferStorage(10))
+	p.Write([]byte("12345678"))
+
+	if n, err := p.Write([]byte("9ABC")); n != 0 || !errors.Is(err, bufpipe.ErrStorageFull) {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 0, bufpipe.ErrStorageFull, n, err)
+	}
+
+	// Reads fail too
+	if n, err := p.Read(make([]byte, 8)); n != 0 || !errors.Is(err, bufpipe.ErrStorageFull) {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 0, bufpipe.ErrStorageFull, n, err)
+	}
+}
+
+func TestFullRejectPipe(t *testing.T) {
+	p, _ := bufpipe.OpenStoragePipe(bufpipe.NewBufferStorage(10), bufpipe.WithFullPolicy(bufpipe.FullReject))
+	p.Write([]byte("12345678"))
+
+	if n, err := p.Write([]byte("9ABC")); n != 0 || !errors.Is(err, bufpipe.ErrStorageFull) {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 0, bufpipe.ErrStorageFull, n, err)
+	}
+	if n, err := p.Write([]byte("9A")); n != 2 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 2, nil, n, err)
+	}
+
+	d := make([]byte, 10)
+	if n, err := p.Read(d); n != 10 || err != nil || string(d) != "123456789A" {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", "123456789A", nil, string(d[:n]), err)
+	}
+
+	// A partial write is removed
+	buf := mock.NewReadWriteSeekable([]byte("12345678"))
+	p, _ = bufpipe.OpenPipe(buf, bufpipe.WithFullPolicy(bufpipe.FullReject))
+	buf.WriteFunc = fullAfter(2, 1)
+	if n, err := p.Write([]byte("9ABC")); n != 0 || !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 0, syscall.ENOSPC, n, err)
+	}
+	if !bytes.Equal([]byte("12345678"), buf.Bytes()) {
+		t.Errorf("Expected %q got %q", "12345678", buf.Bytes())
+	}
+	if n, err := p.Write([]byte("9A")); n != 2 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 2, nil, n, err)
+	}
+}
+
+func TestFullRejectLineIndexedPipe(t *testing.T) {
+	data := &mock.ReadWriteSeekable{}
+	index := &mock.SyncReadWriteSeekable{ReadWriteSeekable: &mock.ReadWriteSeekable{}}
+	p, _ := bufpipe.OpenLineIndexedPipe(data, index, bufpipe.WithFullPolicy(bufpipe.FullReject))
+	p.Write([]byte("a\nb\n"))
+
+	for _, fail := range []func(){
+		func() { data.WriteFunc = fullAfter(1, 1) },
+		func() { index.WriteFunc = fullAfter(3, 1) },
+		func() {
+			// The index entry is written but not synced
+			index.SyncFunc = func() error {
+				index.SyncFunc = nil
+				return syscall.ENOSPC
+			}
+		},
+	} {
+		fail()
+		if n, err := p.Write([]byte("cc\nd")); n != 0 || !errors.Is(err, syscall.ENOSPC) {
+			t.Errorf("Expected [%v, %v] got [%v, %v]", 0, syscall.ENOSPC, n, err)
+		}
+		if !bytes.Equal([]byte("a\nb\n"), data.Bytes()) {
+			t.Errorf("Expected %q got %q", "a\nb\n", data.Bytes())
+		}
+		if n, err := p.CountLines(); n != 2 || err != nil {
+			t.Errorf("Expected [%v, %v] got [%v, %v]", 2, nil, n, err)
+		}
+	}
+
+	if n, err := p.Write([]byte("cc\nd")); n != 4 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 4, nil, n, err)
+	}
+	p.Write([]byte("\n"))
+
+	// One entry per line
+	if n, err := p.IndexSize(); n != 32+4*8 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 32+4*8, nil, n, err)
+	}
+
+	p.SeekLine(2)
+	d := make([]byte, 5)
+	if n, err := io.ReadFull(p, d); n != 5 || err != nil || string(d) != "cc\nd\n" {
+		t.Errorf("Expected [%q, %v] got [%q, %v]", "cc\nd\n", nil, d[:n], err)
+	}
+}
+
+func TestFullRejectLinesWrittenLineIndexedPipe(t *testing.T) {
+	data := &mock.ReadWriteSeekable{}
+	p, _ := bufpipe.OpenLineIndexedPipe(data, &mock.ReadWriteSeekable{}, bufpipe.WithFullPolicy(bufpipe.FullReject))
+	p.Write([]byte("a\n"))
+
+	// The first line is written, the second is full
+	data.WriteFunc = func(rws *mock.ReadWriteSeekable, b []byte) (int, error) {
+		rws.WriteFunc = nil
+		defer func() { rws.WriteFunc = fullAfter(0, 1) }()
+		return rws.Write(b)
+	}
+	if n, err := p.Write([]byte("x\ny\n")); n != 2 || !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 2, syscall.ENOSPC, n, err)
+	}
+	if !bytes.Equal([]byte("a\nx\n"), data.Bytes()) {
+		t.Errorf("Expected %q got %q", "a\nx\n", data.Bytes())
+	}
+	if n, err := p.CountLines(); n != 2 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 2, nil, n, err)
+	}
+
+	if n, err := p.Write([]byte("y\n")); n != 2 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 2, nil, n, err)
+	}
+	d := make([]byte, 6)
+	if n, err := io.ReadFull(p, d); n != 6 || err != nil || string(d) != "a\nx\ny\n" {
+		t.Errorf("Expected [%q, %v] got [%q, %v]", "a\nx\ny\n", nil, d[:n], err)
+	}
+}
+
+func TestFullBlockPipe(t *testing.T) {
+	buf := &mock.ReadWriteSeekable{}
+	p, _ := bufpipe.OpenPipe(buf, bufpipe.WithFullPolicy(bufpipe.FullBlock))
+
+	buf.WriteFunc = fullAfter(1, 3)
+	if n, err := p.Write([]byte("Hello")); n != 5 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 5, nil, n, err)
+	}
+	if !bytes.Equal([]byte("Hello"), buf.Bytes()) {
+		t.Errorf("Expected %q got %q", "Hello", buf.Bytes())
+	}
+
+	// Closing stops a blocked write
+	buf.WriteFunc = fullAfter(0, 1<<30)
+	done := make(chan error)
+	go func() {
+		_, err := p.Write([]byte("World"))
+		done <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	p.Close()
+
+	select {
+	case err := <-done:
+		if err != io.ErrClosedPipe {
+			t.Errorf("Expected %v got %v", io.ErrClosedPipe, err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the write to stop when closed")
+	}
+}
+
+func TestFullBlockLineIndexedPipe(t *testing.T) {
+	p, _ := bufpipe.OpenLineIndexedStoragePipe(bufpipe.NewBufferStorage(64*1024), bufpipe.NewMemoryStorage(),
+		bufpipe.WithFullPolicy(bufpipe.FullBlock))
+
+	var expect []byte
+	for i := 0; i < 80; i++ {
+		expect = append(expect, fmt.Sprintf("%0999d\n", i)...)
+	}
+	p.Write(expect[:40000])
+
+	done := make(chan error)
+	go func() {
+		n, err := p.Write(expect[40000:])
+		if err == nil && n != 40000 {
+			err = io.ErrShortWrite
+		}
+		done <- err
+	}()
+
+	// The index can be used while the write is blocked
+	time.Sleep(20 * time.Millisecond)
+	counted := make(chan int64)
+	go func() {
+		lines, _ := p.CountLines()
+		counted <- lines
+	}()
+	select {
+	case lines := <-counted:
+		if lines < 40 || lines >= 80 {
+			t.Errorf("Expected a blocked write, counted %v lines", lines)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected to count lines while blocked")
+	}
+
+	// Reading makes room for the rest
+	got := make([]byte, 80000)
+	if n, err := io.ReadFull(p, got); n != len(got) || err != nil || !bytes.Equal(expect, got) {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", len(got), nil, n, err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestFullDropOldestPipe(t *testing.T) {
+	p, _ := bufpipe.OpenStoragePipe(bufpipe.NewBufferStorage(64*1024), bufpipe.WithFullPolicy(bufpipe.FullDropOldest))
+	expect := pattern(80000)
+
+	p.Write(expect[:40000])
+	p.Read(make([]byte, 100))
+
+	if n, err := p.Write(expect[40000:]); n != 40000 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 40000, nil, n, err)
+	}
+
+	// The oldest unread data has gone
+	offset, _ := p.Seek(0, os.SEEK_CUR)
+	if offset <= 100 {
+		t.Errorf("Expected to have dropped data, reading from %v", offset)
+	}
+	got := make([]byte, 80000-offset)
+	if n, err := io.ReadFull(p, got); n != len(got) || err != nil || !bytes.Equal(expect[offset:], got) {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", len(got), nil, n, err)
+	}
+
+	// Storage that can not drop data rejects the write
+	buf := &mock.ReadWriteSeekable{WriteFunc: fullAfter(0, 1)}
+	p, _ = bufpipe.OpenPipe(buf, bufpipe.WithFullPolicy(bufpipe.FullDropOldest))
+	if n, err := p.Write([]byte("Hello")); n != 0 || !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 0, syscall.ENOSPC, n, err)
+	}
+	if n, err := p.Write([]byte("Hello")); n != 5 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 5, nil, n, err)
+	}
+}
+
+func TestFullDropOldestLineIndexedPipe(t *testing.T) {
+	p, _ := bufpipe.OpenLineIndexedStoragePipe(bufpipe.NewBufferStorage(64*1024), bufpipe.NewMemoryStorage(),
+		bufpipe.WithFullPolicy(bufpipe.FullDropOldest))
+
+	var expect []byte
+	for i := 0; i < 80; i++ {
+		expect = append(expect, fmt.Sprintf("%0999d\n", i)...)
+	}
+
+	p.Write(expect[:40000])
+	p.Read(make([]byte, 100))
+
+	if n, err := p.Write(expect[40000:]); n != 40000 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 40000, nil, n, err)
+	}
+
+	// Readers are moved to the start of a line
+	offset, _ := p.Seek(0, os.SEEK_CUR)
+	if offset <= 100 || offset%1000 != 0 {
+		t.Errorf("Expected to have dropped whole lines, reading from %v", offset)
+	}
+
+	// Seeking to a dropped line fails without stopping the pipe
+	if err := p.SeekLine(0); err != bufpipe.ErrReleased {
+		t.Errorf("Expected %v got %v", bufpipe.ErrReleased, err)
+	}
+
+	got := make([]byte, 80000-offset)
+	if n, err := io.ReadFull(p, got); n != len(got) || err != nil || !bytes.Equal(expect[offset:], got) {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", len(got), nil, n, err)
+	}
+}
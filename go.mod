@@ -0,0 +1,3 @@
+module github.com/Ladbrokes/bufpipe
+
+go 1.21
@@ -0,0 +1,287 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// Index files start with a header recording how they are laid out. Indexes written before the
+// header was introduced are a bare list of little endian int64 offsets, the first of which is
+// always 0, so they can never be mistaken for a header.
+const (
+	indexMagic      = "BPIX"
+	indexVersion    = 1
+	indexHeaderSize = 32
+
+	indexFlagsOffset = 7
+)
+
+// ErrIndexFormat is returned when an index is not in a recognised format
+var ErrIndexFormat = errors.New("unrecognised index format")
+
+// ErrIndexVersion is returned when an index was written by a newer version of this package
+var ErrIndexVersion = errors.New("unsupported index version")
+
+type indexKind uint8
+
+const (
+	denseKind indexKind = iota
+	sparseKind
+	compactKind
+)
+
+// indexHeader is the versioned header at the start of an index
+type indexHeader struct {
+	Magic     [4]byte
+	Version   uint8
+	Kind      indexKind
+	Delimiter byte
+	Flags     uint8
+	Base      int64         // offset in the data that indexed offsets are relative to
+	Every     IndexInterval // checkpoint interval when sparse, Lines is the block size when compact
+}
+
+func newIndexHeader(kind indexKind) indexHeader {
+	h := indexHeader{
+		Version:   indexVersion,
+		Kind:      kind,
+		Delimiter: '\n',
+	}
+	copy(h.Magic[:], indexMagic)
+	return h
+}
+
+// lineIndex maps line numbers to the offset in the data they start at
+type lineIndex interface {
+	// add records that line starts at offset, lines are added in order
+	add(line, offset int64) error
+	// find returns the closest indexed line at or before line and the offset it starts at
+	find(line int64) (int64, int64, error)
+	// last returns the last indexed line and the offset it starts at, line is -1 if none are
+	last() (int64, int64, error)
+	// reload reads the entries another process has added to the index since it was read
+	reload() error
+}
+
+// openIndex returns the lineIndex stored in s and its header, and whether the index was created
+// or is a legacy index without a header. An empty index is initialised with the given header,
+// otherwise the existing header decides the layout.
+func openIndex(s Storage, h indexHeader) (index lineIndex, header indexHeader, created, legacy bool, err error) {
+	var size int64
+	if size, err = s.Size(); err != nil {
+		return
+	}
+
+	if size == 0 {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, h)
+		if _, err = s.Append(buf.Bytes()); err != nil {
+			// Leave the index empty rather than with part of a header
+			s.Truncate(0)
+			return
+		}
+		return newLineIndex(s, h, indexHeaderSize), h, true, false, nil
+	}
+
+	if h, err = readIndexHeader(s, size); err == errLegacyIndex {
+		return newLineIndex(s, h, 0), h, false, true, nil
+	}
+	if err != nil {
+		return
+	}
+
+	return newLineIndex(s, h, indexHeaderSize), h, false, false, nil
+}
+
+var errLegacyIndex = errors.New("legacy index")
+
+// readIndexHeader reads and validates the header of a non-empty index, errLegacyIndex is returned
+// along with the equivalent header if the index has none.
+func readIndexHeader(r io.ReaderAt, size int64) (h indexHeader, err error) {
+	prefix := make([]byte, int64Size)
+	if size < int64Size {
+		prefix = prefix[:size]
+	}
+	if err = readAt(r, 0, prefix); err != nil {
+		return
+	}
+	if bytes.Count(prefix, []byte{0}) == len(prefix) {
+		return newIndexHeader(denseKind), errLegacyIndex
+	}
+
+	if size < indexHeaderSize {
+		return h, ErrIndexFormat
+	}
+	if err = readAt(r, 0, &h); err != nil {
+		return
+	}
+
+	switch {
+	case string(h.Magic[:]) != indexMagic:
+		return h, ErrIndexFormat
+	case h.Version == 0:
+		// Never written, versions start at 1
+		return h, ErrIndexFormat
+	case h.Version > indexVersion:
+		return h, ErrIndexVersion
+	case h.Kind > compactKind:
+		return h, ErrIndexFormat
+	case h.Kind == compactKind && h.Every.Lines <= 0:
+		return h, ErrIndexFormat
+	}
+
+	return
+}
+
+func newLineIndex(s Storage, h indexHeader, start int64) lineIndex {
+	switch h.Kind {
+	case sparseKind:
+		return &sparseIndex{s: s, start: start, base: h.Base, every: h.Every}
+	case compactKind:
+		return &compactIndex{s: s, start: start, base: h.Base, block: h.Every.Lines}
+	}
+	return &denseIndex{s: s, start: start, base: h.Base}
+}
+
+// MigrateIndex copies a legacy headerless index from src to dst, adding a header.
+// ErrIndexFormat is returned if src is not a legacy index.
+func MigrateIndex(dst io.Writer, src io.ReadSeeker) (err error) {
+	var size int64
+	if size, err = src.Seek(0, os.SEEK_END); err != nil {
+		return
+	}
+	if size > 0 {
+		if _, err = readIndexHeader(seekReaderAt{src}, size); err != errLegacyIndex {
+			if err == nil {
+				err = ErrIndexFormat
+			}
+			return
+		}
+	}
+
+	if err = binary.Write(dst, binary.LittleEndian, newIndexHeader(denseKind)); err != nil {
+		return
+	}
+
+	if _, err = src.Seek(0, os.SEEK_SET); err != nil {
+		return
+	}
+
+	_, err = io.Copy(dst, src)
+	return
+}
+
+// MigrateIndexFile replaces a legacy headerless index file with one that has a header, an index
+// that already has a header is left untouched. The file must not be in use while migrating.
+func MigrateIndexFile(path string) (err error) {
+	var src *os.File
+	if src, err = os.Open(path); err != nil {
+		return
+	}
+	defer src.Close()
+
+	var info os.FileInfo
+	if info, err = src.Stat(); err != nil {
+		return
+	}
+	if info.Size() > 0 {
+		if _, err = readIndexHeader(src, info.Size()); err != errLegacyIndex {
+			return
+		}
+	}
+
+	tmp := path + ".migrate"
+	var dst *os.File
+	if dst, err = os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode()); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+
+	if err = MigrateIndex(dst, src); err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// denseIndex stores the offset of every line as a little endian int64
+type denseIndex struct {
+	s     Storage
+	start int64
+	base  int64
+}
+
+func (d *denseIndex) add(line, offset int64) (err error) {
+	buf := make([]byte, int64Size)
+	binary.LittleEndian.PutUint64(buf, uint64(offset-d.base))
+	_, err = d.s.Append(buf)
+	return
+}
+
+func (d *denseIndex) find(line int64) (int64, int64, error) {
+	var offset int64
+	err := readAt(d.s, d.start+line*int64Size, &offset)
+	return line, d.base + offset, err
+}
+
+// reload has nothing to do, each lookup reads the index
+func (d *denseIndex) reload() error {
+	return nil
+}
+
+// last also drops a partially written entry from the end of the index
+func (d *denseIndex) last() (line, offset int64, err error) {
+	var size int64
+	if size, err = d.s.Size(); err != nil {
+		return
+	}
+
+	if torn := (size - d.start) % int64Size; torn != 0 {
+		if err = d.s.Truncate(size - torn); err != nil {
+			return
+		}
+	}
+
+	if line = (size-d.start)/int64Size - 1; line < 0 {
+		return
+	}
+
+	_, offset, err = d.find(line)
+	return
+}
+
+// readAt reads the little endian value v from position pos
+func readAt(r io.ReaderAt, pos int64, v interface{}) error {
+	return binary.Read(io.NewSectionReader(r, pos, int64(binary.Size(v))), binary.LittleEndian, v)
+}
+
+// seekReaderAt reads positionally from a ReadSeeker by seeking
+type seekReaderAt struct {
+	io.ReadSeeker
+}
+
+func (r seekReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	if _, err = r.Seek(off, os.SEEK_SET); err != nil {
+		return
+	}
+	if n, err = io.ReadFull(r, p); err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return
+}
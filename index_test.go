@@ -0,0 +1,124 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Ladbrokes/bufpipe"
+	"github.com/Ladbrokes/bufpipe/mock"
+)
+
+var legacyIndex = []byte{0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 13, 0, 0, 0, 0, 0, 0, 0}
+
+func TestLegacyIndexedPipe(t *testing.T) {
+	index := mock.NewReadWriteSeekable(append([]byte{}, legacyIndex...))
+	p := bufpipe.NewLineIndexedPipe(mock.NewReadWriteSeekable([]byte("\nHello World\n\n")), index)
+
+	if n, err := p.CountLines(); n != 3 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 3, nil, n, err)
+	}
+
+	p.Write([]byte("Again\n"))
+
+	// Still headerless
+	if expect := append(legacyIndex, 14, 0, 0, 0, 0, 0, 0, 0); !bytes.Equal(expect, index.Bytes()) {
+		t.Errorf("Expected %v got %v", expect, index.Bytes())
+	}
+}
+
+func TestBadIndexHeaderIndexedPipe(t *testing.T) {
+	header := []byte{'B', 'P', 'I', 'X', 1, 0, '\n', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	for _, test := range []struct {
+		index  []byte
+		expect error
+	}{
+		{[]byte("BPIX"), bufpipe.ErrIndexFormat},
+		{append([]byte("XXXX"), header[4:]...), bufpipe.ErrIndexFormat},
+		{append(append([]byte("BPIX"), 0), header[5:]...), bufpipe.ErrIndexFormat},
+		{append(append([]byte("BPIX"), 2), header[5:]...), bufpipe.ErrIndexVersion},
+		{append(append([]byte("BPIX"), 1, 9), header[6:]...), bufpipe.ErrIndexFormat},
+	} {
+		p := bufpipe.NewLineIndexedPipe(&mock.ReadWriteSeekable{}, mock.NewReadWriteSeekable(test.index))
+		if _, err := p.CountLines(); !errors.Is(err, test.expect) {
+			t.Errorf("Expected %v got %v", test.expect, err)
+		}
+	}
+}
+
+func TestSparseHeaderIndexedPipe(t *testing.T) {
+	data := &mock.ReadWriteSeekable{}
+	index := &mock.ReadWriteSeekable{}
+	p := bufpipe.NewSparseLineIndexedPipe(data, index, bufpipe.IndexInterval{Lines: 10})
+	writeNumberedLines(t, p, 0, 15)
+
+	// The header decides the layout, not the constructor
+	p = bufpipe.NewLineIndexedPipe(data, index)
+	writeNumberedLines(t, p, 15, 25)
+
+	if n, err := p.IndexSize(); n != 32+3*16 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 32+3*16, nil, n, err)
+	}
+
+	testSeekLines(t, p, 25)
+}
+
+func TestMigrateIndex(t *testing.T) {
+	var migrated bytes.Buffer
+	if err := bufpipe.MigrateIndex(&migrated, mock.NewReadWriteSeekable(legacyIndex)); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	var fresh mock.ReadWriteSeekable
+	p := bufpipe.NewLineIndexedPipe(&mock.ReadWriteSeekable{}, &fresh)
+	p.Write([]byte("\nHello World\n\n"))
+
+	if !bytes.Equal(fresh.Bytes(), migrated.Bytes()) {
+		t.Errorf("Expected %v got %v", fresh.Bytes(), migrated.Bytes())
+	}
+
+	if err := bufpipe.MigrateIndex(&migrated, mock.NewReadWriteSeekable(fresh.Bytes())); err != bufpipe.ErrIndexFormat {
+		t.Errorf("Expected %v got %v", bufpipe.ErrIndexFormat, err)
+	}
+}
+
+func TestMigrateIndexFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testmigrate")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, index := filepath.Join(dir, "data"), filepath.Join(dir, "index")
+	ioutil.WriteFile(data, []byte("\nHello World\n\n"), 0666)
+	ioutil.WriteFile(index, legacyIndex, 0666)
+
+	for i := 0; i < 2; i++ {
+		if err := bufpipe.MigrateIndexFile(index); err != nil {
+			t.Errorf("Unexpected error %v", err)
+		}
+		if info, err := os.Stat(index); err != nil || info.Size() != 56 {
+			t.Errorf("Expected a migrated index, got %v %v", info, err)
+		}
+	}
+
+	p, err := bufpipe.NewLineIndexedFilePipe(data, index, 0666)
+	if err != nil {
+		t.Fatal("Unable to create IndexedFile object", err)
+	}
+	defer p.Close()
+
+	if n, err := p.CountLines(); n != 3 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 3, nil, n, err)
+	}
+
+	if err := bufpipe.MigrateIndexFile(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("Expected a not exist error got %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// indexMapChunk is the granularity the mapping of an index grows by
+var indexMapChunk int64 = 1 << 20
+
+// indexMap serves dense index lookups from a read only memory mapping of the index file, the
+// mapping is grown as the index does. Lookups are memory reads that do not need the pipe lock.
+type indexMap struct {
+	f *os.File
+
+	mu     sync.RWMutex // protects data and closed
+	data   []byte
+	closed bool
+
+	start   int64
+	base    int64
+	entries int64 // atomic, entries that have been written and synced
+	size    int64 // atomic, size of the index as IndexSize reports it
+	ready   int32 // atomic, set once start and base are known
+}
+
+func newIndexMap(f *os.File) *indexMap {
+	if !mmapSupported {
+		return nil
+	}
+	return &indexMap{f: f}
+}
+
+// setup is called once the layout of the index is known, and again with the entries found
+// when the index is loaded after recovering from an error, along with the size of the index.
+// Only dense indexes are mapped.
+func (m *indexMap) setup(index lineIndex, entries, size int64) {
+	d, ok := index.(*denseIndex)
+	if !ok {
+		return
+	}
+	if atomic.LoadInt32(&m.ready) != 0 {
+		atomic.StoreInt64(&m.size, size)
+		atomic.StoreInt64(&m.entries, entries)
+		return
+	}
+	m.start, m.base = d.start, d.base
+	atomic.StoreInt64(&m.size, size)
+	atomic.StoreInt64(&m.entries, entries)
+	atomic.StoreInt32(&m.ready, 1)
+}
+
+func (m *indexMap) isReady() bool {
+	return m != nil && atomic.LoadInt32(&m.ready) != 0
+}
+
+// commit is called once the entry for every line before entries has been written and synced
+func (m *indexMap) commit(entries int64) {
+	if size := m.start + entries*int64Size; size > atomic.LoadInt64(&m.size) {
+		atomic.StoreInt64(&m.size, size)
+	}
+	atomic.StoreInt64(&m.entries, entries)
+}
+
+func (m *indexMap) count() int64 {
+	return atomic.LoadInt64(&m.entries)
+}
+
+func (m *indexMap) indexSize() int64 {
+	return atomic.LoadInt64(&m.size)
+}
+
+func (m *indexMap) find(line int64) (offset int64, err error) {
+	if line < 0 || line >= m.count() {
+		return 0, io.EOF
+	}
+
+	pos := m.start + line*int64Size
+	end := pos + int64Size
+
+	m.mu.RLock()
+	if end > int64(len(m.data)) {
+		m.mu.RUnlock()
+		if err = m.grow(end); err != nil {
+			return
+		}
+		m.mu.RLock()
+	}
+	defer m.mu.RUnlock()
+
+	// Closed since growing
+	if m.closed {
+		return 0, io.ErrClosedPipe
+	}
+	offset = m.base + int64(binary.LittleEndian.Uint64(m.data[pos:end]))
+
+	return
+}
+
+// grow maps at least size bytes of the index, which must already have been written
+func (m *indexMap) grow(size int64) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return io.ErrClosedPipe
+	}
+	if size <= int64(len(m.data)) {
+		return
+	}
+
+	length := (size + indexMapChunk - 1) / indexMapChunk * indexMapChunk
+
+	var data []byte
+	if data, err = mmap(m.f, int(length)); err != nil {
+		return
+	}
+	if m.data != nil {
+		munmap(m.data)
+	}
+	m.data = data
+
+	return
+}
+
+func (m *indexMap) close() (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+	if m.data != nil {
+		err = munmap(m.data)
+		m.data = nil
+	}
+	return
+}
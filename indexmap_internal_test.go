@@ -0,0 +1,194 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestMappedLineIndexedFilePipe(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("mmap is not supported on this platform")
+	}
+
+	defer func(chunk int64) { indexMapChunk = chunk }(indexMapChunk)
+	indexMapChunk = 4096
+
+	dir, err := ioutil.TempDir("", "testmapped")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, index := filepath.Join(dir, "data"), filepath.Join(dir, "index")
+
+	p, err := NewMappedLineIndexedFilePipe(data, index, 0666)
+	if err != nil {
+		t.Fatal("Unable to create IndexedFile object", err)
+	}
+
+	if !p.mapped.isReady() {
+		t.Fatal("Expected the index to be mapped")
+	}
+
+	// Look up lines while the index grows past several chunks of mapping
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 2000; i++ {
+			fmt.Fprintf(p, "line %d\n", i)
+		}
+	}()
+	for i := 0; i < 2000; i++ {
+		if n, _ := p.CountLines(); n > 0 {
+			if err := p.SeekLine(n - 1); err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+		}
+	}
+	wg.Wait()
+
+	if n, err := p.IndexSize(); n != 32+2000*8 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 32+2000*8, nil, n, err)
+	}
+	p.Close()
+
+	// Reopened with the existing index
+	p, err = NewMappedLineIndexedFilePipe(data, index, 0666)
+	if err != nil {
+		t.Fatal("Unable to reopen IndexedFile object", err)
+	}
+	defer p.Close()
+
+	if n, err := p.CountLines(); n != 2000 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 2000, nil, n, err)
+	}
+
+	for _, line := range []int64{0, 1, 511, 512, 1999} {
+		if err := p.SeekLine(line); err != nil {
+			t.Errorf("Unexpected error %v", err)
+		}
+		d := make([]byte, 16)
+		n, _ := p.Read(d)
+		if expect := fmt.Sprintf("line %d\n", line); string(d[:len(expect)]) != expect {
+			t.Errorf("Expected %q got %q", expect, d[:n])
+		}
+	}
+
+	if err := p.SeekLine(2000); err == nil {
+		t.Error("Expected an error seeking past the last line")
+	}
+}
+
+func TestMappedLineIndexedFilePipeClosed(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("mmap is not supported on this platform")
+	}
+
+	dir, err := ioutil.TempDir("", "testmapped")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, err := NewMappedLineIndexedFilePipe(filepath.Join(dir, "data"), filepath.Join(dir, "index"), 0666)
+	if err != nil {
+		t.Fatal("Unable to create IndexedFile object", err)
+	}
+	p.Write([]byte("Hello\n"))
+
+	// Look ups racing close fail rather than read an unmapped index
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			if _, err := p.mapped.find(0); err != nil && err != io.ErrClosedPipe {
+				t.Errorf("Unexpected error %v", err)
+				return
+			}
+		}
+	}()
+	p.mapped.close()
+	wg.Wait()
+
+	if _, err := p.mapped.find(0); err != io.ErrClosedPipe {
+		t.Errorf("Expected %v got %v", io.ErrClosedPipe, err)
+	}
+	p.Close()
+}
+
+func TestMappedLineIndexedFilePipeIndexSize(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("mmap is not supported on this platform")
+	}
+
+	dir, err := ioutil.TempDir("", "testmapped")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, index := filepath.Join(dir, "data"), filepath.Join(dir, "index")
+
+	p, err := NewLineIndexedFilePipe(data, index, 0666)
+	if err != nil {
+		t.Fatal("Unable to create IndexedFile object", err)
+	}
+	p.Write([]byte("Hello\nWorld\n"))
+	p.Close()
+
+	// An entry for the next line, as left by a rolled back write
+	f, err := os.OpenFile(index, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal("Unable to open index", err)
+	}
+	entry := make([]byte, int64Size)
+	binary.LittleEndian.PutUint64(entry, 12)
+	f.Write(entry)
+	f.Close()
+
+	sizes := func() (unmapped, mapped int64) {
+		p, err := NewLineIndexedFilePipe(data, index, 0666)
+		if err != nil {
+			t.Fatal("Unable to open IndexedFile object", err)
+		}
+		unmapped, _ = p.IndexSize()
+		p.Close()
+
+		if p, err = NewMappedLineIndexedFilePipe(data, index, 0666); err != nil {
+			t.Fatal("Unable to open IndexedFile object", err)
+		}
+		mapped, _ = p.IndexSize()
+		p.Close()
+		return
+	}
+
+	if unmapped, mapped := sizes(); unmapped != 32+3*8 || mapped != unmapped {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 32+3*8, 32+3*8, unmapped, mapped)
+	}
+
+	p, err = NewMappedLineIndexedFilePipe(data, index, 0666)
+	if err != nil {
+		t.Fatal("Unable to open IndexedFile object", err)
+	}
+	p.Write([]byte("Again\n"))
+	if n, err := p.IndexSize(); n != 32+3*8 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 32+3*8, nil, n, err)
+	}
+	p.Write([]byte("More\n"))
+	p.Close()
+
+	if unmapped, mapped := sizes(); unmapped != 32+4*8 || mapped != unmapped {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 32+4*8, 32+4*8, unmapped, mapped)
+	}
+}
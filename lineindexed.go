@@ -6,151 +6,617 @@ package bufpipe
 import (
 	"bufio"
 	"bytes"
-	"encoding/binary"
+	"errors"
 	"io"
 	"os"
+	"sort"
+	"sync"
+	"time"
 )
 
-// LineIndexedPipe provides a ReadWriter interface to store line deliminited data in an indexed fasion in a pair of ReadWriteSeekers
+// LineIndexedPipe provides a ReadWriter interface to store line deliminited data in an indexed fasion in a pair of Storages
 type LineIndexedPipe struct {
 	*Pipe
-	index io.ReadWriteSeeker
+	index   Storage
+	format  indexHeader // used to initialise an empty index, then the header of the index
+	legacy  bool        // the index has no header
+	indexer lineIndex
+	times   Storage   // optional, write time of each line
+	sums    Storage   // optional, CRC32C of each line
+	chain   Storage   // optional, SHA-256 of each line chained over the one before
+	tree    Storage   // optional, Merkle tree of the lines
+	mapped  *indexMap // optional, memory mapped index for lookups
 
-	lastIndex int64
+	loaded    bool  // lines and lastIndex have been recovered from the stores
+	lines     int64 // number of complete lines
+	lastIndex int64 // offset the next line starts at
+	nextAdded bool  // the index has an entry for the next line, left by a rolled back write
+	unindexed int64 // complete lines after the last in the index, only left when read only
+	lastTime  int64
+	timesRead bool // lastTime has been read from times
+	sumsRead  bool // sums has been checked to end at lines
+	chainRead bool // head has been read from chain
+	treeRead  bool // tree has been checked to end at lines
+	head      [hashSize]byte
+
+	cl     sync.Mutex // guards cursor
+	cursor lineCursor
+
+	now func() time.Time
 }
 
 const int64Size = 8
 
-// NewLineIndexedPipe returns a new line indexed pipe structure
+// NewLineIndexedPipe returns a new line indexed pipe structure, the index stores the offset
+// of every line as a little endian int64 following a versioned header.
+// An existing index keeps the layout it was created with.
 func NewLineIndexedPipe(data, index io.ReadWriteSeeker) *LineIndexedPipe {
-	l := &LineIndexedPipe{
-		Pipe:  NewPipe(data),
-		index: index,
+	return newLineIndexedPipe(NewStorage(data), NewStorage(index))
+}
+
+// NewLineIndexedStoragePipe is NewLineIndexedPipe for Storage
+func NewLineIndexedStoragePipe(data, index Storage) *LineIndexedPipe {
+	return newLineIndexedPipe(data, index)
+}
+
+// OpenLineIndexedPipe returns a new line indexed pipe structure configured by opts, see
+// NewLineIndexedPipe. Unlike NewLineIndexedPipe the index is read before returning, so an
+// unreadable or unrecognised index is returned as an error.
+func OpenLineIndexedPipe(data, index io.ReadWriteSeeker, opts ...Option) (*LineIndexedPipe, error) {
+	return OpenLineIndexedStoragePipe(NewStorage(data), NewStorage(index), opts...)
+}
+
+// OpenLineIndexedStoragePipe is OpenLineIndexedPipe for Storage
+func OpenLineIndexedStoragePipe(data, index Storage, opts ...Option) (*LineIndexedPipe, error) {
+	l, err := openLineIndexedPipe(data, index, newOptions(opts))
+	if err != nil {
+		return nil, err
+	}
+
+	l.wl.Lock()
+	defer l.wl.Unlock()
+
+	if err = l.load(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// newLineIndexedPipe is OpenLineIndexedStoragePipe leaving the index to be read on first use,
+// as the New functions do. It panics if the size of data can not be found.
+func newLineIndexedPipe(data, index Storage, opts ...Option) *LineIndexedPipe {
+	l, err := openLineIndexedPipe(data, index, newOptions(opts))
+	if err != nil {
+		panic(err)
 	}
 	return l
 }
 
+func openLineIndexedPipe(data, index Storage, o *options) (*LineIndexedPipe, error) {
+	p, err := openPipe(data, o)
+	if err != nil {
+		return nil, err
+	}
+
+	times, sums, chain, tree := o.times, o.sums, o.chain, o.tree
+	if o.readOnly {
+		index, times = newReadOnlyStorage(index), newReadOnlyStorage(times)
+		sums, chain, tree = newReadOnlyStorage(sums), newReadOnlyStorage(chain), newReadOnlyStorage(tree)
+	}
+
+	l := &LineIndexedPipe{
+		Pipe:   p,
+		index:  index,
+		format: o.format,
+		times:  times,
+		sums:   sums,
+		chain:  chain,
+		tree:   tree,
+		now:    time.Now,
+	}
+	p.boundary = l.nextLine
+
+	// The mapping is not grown as another process writes the index
+	if f, ok := index.(interface{ file() *os.File }); ok && o.mapped && !o.readOnly {
+		l.mapped = newIndexMap(f.file())
+	}
+
+	return l, nil
+}
+
 // Write implements the standard Write interface: it writes data to the pipe, blocking
 // until readers have consumed all the data or the read end is closed. If the read end
 // is closed with an error, that err is returned as err; otherwise err is ErrClosedPipe.
 func (l *LineIndexedPipe) Write(p []byte) (n int, err error) {
-	n, err = func() (n int, err error) {
-		l.l.Lock()
-		defer l.l.Unlock()
+	if l.readOnly {
+		return 0, ErrReadOnly
+	}
 
-		if l.rerr != nil {
-			err = l.rerr
-			return
-		}
-		if l.werr != nil {
-			err = io.ErrClosedPipe
+	l.wl.Lock()
+	defer l.wl.Unlock()
+
+	if err = l.fits(len(p)); err != nil {
+		return
+	}
+
+	var written int64
+	n, err = func() (n int, err error) {
+		if err = l.writable(); err != nil {
 			return
 		}
 
-		// Go back to last known good size
-		if _, err = l.data.Seek(l.size, os.SEEK_SET); err != nil {
+		if err = l.retryFull(len(p), l.load, l.unload); err != nil {
 			return
 		}
 
+		rest := len(p)
 		scanner := bufio.NewScanner(bytes.NewReader(p))
-		scanner.Split(scanLines)
+		scanner.Split(splitLines(l.format.Delimiter))
 		for scanner.Scan() {
 			var wn int
 
 			output := scanner.Bytes()
-			wn, err = l.data.Write(output)
-			n += wn
+			err = l.retryFull(rest, func() (err error) {
+				if err = l.load(); err != nil {
+					return
+				}
 
-			if err != nil {
+				if wn, err = l.data.Append(output); err != nil {
+					return pipeError("write", "data", err)
+				}
+
+				if output[len(output)-1] == l.format.Delimiter {
+					if err = l.writeIndex(output, l.size+written+int64(wn)); err != nil {
+						wn = 0
+					}
+				}
 				return
-			}
+			}, func() error {
+				// Reloading the index needs the lines written so far
+				l.l.Lock()
+				l.size += written
+				l.rwait.Broadcast()
+				l.l.Unlock()
+				written, wn = 0, 0
 
-			if output[len(output)-1] == '\n' {
-				if err = l.writeIndex(); err != nil {
-					n = n - wn
-					return
+				if err := l.data.Truncate(l.size); err != nil {
+					return pipeError("truncate", "data", err)
 				}
+				return l.unload()
+			})
+
+			n += wn
+			if err != nil {
+				return
 			}
 
 			// Succeeded in writing the index so this is the new file length
-			l.size += int64(wn)
+			written += int64(wn)
+			rest -= len(output)
 		}
 
 		err = scanner.Err()
 
-		l.rwait.Signal()
-
 		return
 	}()
-	if err != nil {
+
+	l.l.Lock()
+	defer l.l.Unlock()
+
+	l.size += written
+	if l.stops(err) {
+		if l.werr == nil {
+			l.logf("bufpipe: write failed, closing pipe: %v", err)
+		}
 		l.werr = err
 	}
+	l.rwait.Broadcast()
+
 	return
 }
 
-// SeekLine sets the reader position to the beginning of the given line
+// SeekLine sets the reader position to the beginning of the given line. ErrReleased is returned
+// for a line whose data has been released, see Releaser, leaving the position unchanged.
 func (l *LineIndexedPipe) SeekLine(line int64) (err error) {
-	err = func() (err error) {
+	var offset int64
+	if l.mapped.isReady() {
+		if offset, err = l.mapped.find(line); err != nil {
+			err = pipeError("read", "index", err)
+		}
+	} else {
+		offset, err = func() (offset int64, err error) {
+			l.wl.Lock()
+			defer l.wl.Unlock()
 
-		l.l.Lock()
-		defer l.l.Unlock()
+			if err = l.load(); err != nil {
+				return
+			}
 
-		if _, err = l.index.Seek(line*int64Size, os.SEEK_SET); err != nil {
-			return
-		}
+			return l.lineOffset(line)
+		}()
+	}
 
-		err = binary.Read(l.index, binary.LittleEndian, &l.readIndex)
+	l.l.Lock()
+	defer l.l.Unlock()
 
-		return
-	}()
 	if err != nil {
 		l.rerr = err
+		return
 	}
+	if m, ok := l.release.(*MemoryStorage); ok && offset < m.releasedTo() {
+		// Dropped or read past, the pipe can go on being read from where it is
+		return ErrReleased
+	}
+
+	l.readIndex = offset
+	if l.sums != nil {
+		l.seekCursor(line, offset)
+	}
+
 	return
 }
 
 // CountLines returns the number of lines stored
 func (l *LineIndexedPipe) CountLines() (int64, error) {
-	size, err := l.IndexSize()
-	return size / int64Size, err
+	if l.mapped.isReady() {
+		return l.mapped.count(), nil
+	}
+
+	l.wl.Lock()
+	defer l.wl.Unlock()
+
+	err := l.load()
+	return l.lines, err
 }
 
 // IndexSize returns the size of the index on disk/in memory
 func (l *LineIndexedPipe) IndexSize() (int64, error) {
-	l.l.Lock()
-	defer l.l.Unlock()
+	if l.mapped.isReady() {
+		return l.mapped.indexSize(), nil
+	}
+
+	l.wl.Lock()
+	defer l.wl.Unlock()
+
+	return l.index.Size()
+}
+
+// Close closes the pipe and then its Storages once any write in progress finishes, rendering
+// the pipe unusable for I/O. It returns every error closing the Storages, if any.
+func (l *LineIndexedPipe) Close() error {
+	l.close()
+
+	l.wl.Lock()
+	defer l.wl.Unlock()
+
+	errs := []error{
+		pipeError("close", "data", l.data.Close()),
+		pipeError("close", "index", l.index.Close()),
+	}
+	if l.times != nil {
+		errs = append(errs, pipeError("close", "times", l.times.Close()))
+	}
+	if l.sums != nil {
+		errs = append(errs, pipeError("close", "sums", l.sums.Close()))
+	}
+	if l.chain != nil {
+		errs = append(errs, pipeError("close", "chain", l.chain.Close()))
+	}
+	if l.tree != nil {
+		errs = append(errs, pipeError("close", "tree", l.tree.Close()))
+	}
+	if l.mapped != nil {
+		errs = append(errs, pipeError("close", "index", l.mapped.close()))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Recover clears the error that stopped the pipe, such as a temporary failure of one of its
+// Storages, once the data and index have been read again as they are when first used. Lines
+// a failed write left in the data are added to the index. Recover returns io.ErrClosedPipe if
+// the pipe was closed by Close.
+func (l *LineIndexedPipe) Recover() (err error) {
+	l.wl.Lock()
+	defer l.wl.Unlock()
+
+	if err = l.resize(); err != nil {
+		return
+	}
+
+	l.unload()
+	if err = l.load(); err != nil {
+		return
+	}
 
-	return l.index.Seek(0, os.SEEK_END)
+	return l.clearError()
 }
 
-func scanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
-	if atEOF && len(data) == 0 {
+// splitLines returns a bufio.SplitFunc that splits after each delim, keeping the delimiter
+func splitLines(delim byte) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		if atEOF && len(data) == 0 {
+			return 0, nil, nil
+		}
+		if i := bytes.IndexByte(data, delim); i >= 0 {
+			return i + 1, data[0 : i+1], nil
+		}
+		if atEOF {
+			return len(data), data, nil
+		}
 		return 0, nil, nil
 	}
-	if i := bytes.IndexByte(data, '\n'); i >= 0 {
-		return i + 1, data[0 : i+1], nil
+}
+
+// lineOffset returns the offset the given line starts at
+func (l *LineIndexedPipe) lineOffset(line int64) (offset int64, err error) {
+	if l.indexer == nil {
+		// A read only pipe whose index has not been created
+		return 0, io.EOF
+	}
+
+	// Lines missing from the index of a read only pipe are found from the last that is in it
+	find := line
+	if first := l.lines - l.unindexed; l.unindexed > 0 && line >= first {
+		find = first - 1
+	}
+
+	var indexed int64
+	if find < 0 {
+		indexed, offset = 0, 0
+	} else if indexed, offset, err = l.indexer.find(find); err != nil {
+		return 0, pipeError("read", "index", err)
+	}
+
+	// Sparse indexes only know of some lines, the rest are found by scanning forward
+	if indexed < line {
+		if line >= l.lines {
+			return 0, io.EOF
+		}
+		err = l.scanData(offset, l.lastIndex, func(end int64) bool {
+			offset = end
+			indexed++
+			return indexed < line
+		})
+	}
+
+	return
+}
+
+// nextLine returns where the first line starting at or after offset starts, or where the line
+// being written starts if none do. The caller must hold wl.
+func (l *LineIndexedPipe) nextLine(offset int64) (start int64, err error) {
+	if err = l.load(); err != nil || offset >= l.lastIndex {
+		return l.lastIndex, err
 	}
-	if atEOF {
-		return len(data), data, nil
+
+	i := sort.Search(int(l.lines), func(i int) bool {
+		if err != nil {
+			return true
+		}
+		var o int64
+		o, err = l.lineOffset(int64(i))
+		return o >= offset
+	})
+	if err != nil || int64(i) == l.lines {
+		return l.lastIndex, err
 	}
-	return 0, nil, nil
+
+	return l.lineOffset(int64(i))
 }
 
-func (l *LineIndexedPipe) writeIndex() (err error) {
-	if _, err = l.index.Seek(0, os.SEEK_END); err != nil {
+// load recovers the line count and the start of the next line from the index and the
+// data written after the last indexed line. Complete lines missing from the index, as left
+// behind by a failed index write, are added to it, or only counted if the pipe is read only.
+func (l *LineIndexedPipe) load() (err error) {
+	if l.loaded {
 		return
 	}
 
-	if err = binary.Write(l.index, binary.LittleEndian, l.lastIndex); err != nil {
-		return err
+	if l.indexer == nil {
+		// An empty index is created by the process writing the pipe, until then there are no lines
+		if l.readOnly {
+			var size int64
+			if size, err = l.index.Size(); err != nil {
+				return pipeError("size", "index", err)
+			}
+			if size == 0 {
+				l.lines, l.lastIndex = 0, 0
+				return
+			}
+		}
+
+		var indexer lineIndex
+		var format indexHeader
+		var created, legacy bool
+		if indexer, format, created, legacy, err = openIndex(l.index, l.format); err != nil {
+			return pipeError("load", "index", err)
+		}
+		l.indexer, l.format, l.legacy = indexer, format, legacy
+		if created {
+			if err = l.syncData(l.index); err != nil {
+				return pipeError("sync", "index", err)
+			}
+		}
+	}
+
+	var line, offset int64
+	if line, offset, err = l.indexer.last(); err != nil {
+		return pipeError("load", "index", err)
+	}
+
+	lines, lastIndex := line, offset
+	if line < 0 {
+		lines, lastIndex = 0, 0
+	}
+
+	var addErr error
+	var unindexed int64
+	err = l.scanData(lastIndex, l.size, func(end int64) bool {
+		if lines > line {
+			if l.readOnly {
+				unindexed++
+				lines++
+				lastIndex = end
+				return true
+			}
+			if addErr = l.indexer.add(lines, lastIndex); addErr != nil {
+				return false
+			}
+		}
+		lines++
+		lastIndex = end
+		return true
+	})
+	if err != nil {
+		return
+	}
+	if addErr != nil {
+		return pipeError("write", "index", addErr)
+	}
+	if line < lines-1 && !l.readOnly {
+		l.logf("bufpipe: added %d lines missing from the index", lines-1-line)
+	}
+
+	l.lines, l.lastIndex, l.unindexed, l.loaded = lines, lastIndex, unindexed, true
+	l.nextAdded = line >= 0 && line == lines
+
+	if l.mapped != nil {
+		var size int64
+		if size, err = l.index.Size(); err != nil {
+			return pipeError("size", "index", err)
+		}
+		l.mapped.setup(l.indexer, l.lines, size)
+	}
+
+	return
+}
+
+// reload picks up the lines another process has added to the data and index since they were
+// loaded, reading only what has been added to the index since
+func (l *LineIndexedPipe) reload() error {
+	if !l.loaded || l.indexer == nil {
+		l.unload()
+		return l.load()
+	}
+
+	if err := l.indexer.reload(); err != nil {
+		return pipeError("load", "index", err)
+	}
+	l.loaded = false
+	return l.load()
+}
+
+// unload has the stores read again on next use, after a failed write
+func (l *LineIndexedPipe) unload() error {
+	l.indexer, l.loaded = nil, false
+	l.timesRead, l.sumsRead, l.chainRead, l.treeRead = false, false, false, false
+	return nil
+}
+
+// scanData calls fn with the offset following each line delimiter in the data between from
+// and to until fn returns false
+func (l *LineIndexedPipe) scanData(from, to int64, fn func(end int64) bool) (err error) {
+	buf := make([]byte, 32*1024)
+	for from < to {
+		if int64(len(buf)) > to-from {
+			buf = buf[:to-from]
+		}
+
+		var n int
+		if n, err = l.readData(buf, from); err != nil {
+			return
+		}
+
+		for d := buf[:n]; len(d) > 0; {
+			i := bytes.IndexByte(d, l.format.Delimiter)
+			if i < 0 {
+				break
+			}
+			if !fn(from + int64(n-len(d)+i+1)) {
+				return
+			}
+			d = d[i+1:]
+		}
+
+		from += int64(n)
 	}
 
-	if err = l.syncWriter(l.index); err != nil {
-		return err
+	return
+}
+
+// writeIndex records the line that has been completed, tail is the end of it that has just been
+// written and next is where the following line starts
+func (l *LineIndexedPipe) writeIndex(tail []byte, next int64) (err error) {
+	if l.tree != nil {
+		// On failure the hashes of this line may have been written, have the next write check
+		defer func() {
+			if err != nil {
+				l.treeRead = false
+			}
+		}()
+
+		if err = l.writeLeaf(l.lines, tail, next); err != nil {
+			return
+		}
 	}
 
-	if l.lastIndex, err = l.data.Seek(0, os.SEEK_END); err != nil {
-		return err
+	if l.chain != nil {
+		// On failure the hash of this line may have been written, have the next write check
+		defer func() {
+			if err != nil {
+				l.chainRead = false
+			}
+		}()
+
+		if err = l.writeHash(l.lines, tail, next); err != nil {
+			return
+		}
+	}
+
+	if l.sums != nil {
+		// On failure the checksum of this line may have been written, have the next write check
+		defer func() {
+			if err != nil {
+				l.sumsRead = false
+			}
+		}()
+
+		if err = l.writeSum(l.lines, tail, next); err != nil {
+			return
+		}
+	}
+
+	if l.times != nil {
+		// On failure the time of this line may have been written, have the next write check
+		defer func() {
+			if err != nil {
+				l.timesRead = false
+			}
+		}()
+
+		if err = l.writeTime(l.lines); err != nil {
+			return
+		}
+	}
+
+	if !l.nextAdded {
+		if err = l.indexer.add(l.lines, l.lastIndex); err != nil {
+			return pipeError("write", "index", err)
+		}
+	}
+
+	if err = l.syncData(l.index); err != nil {
+		return pipeError("sync", "index", err)
+	}
+
+	l.lastIndex = next
+	l.lines++
+	l.nextAdded = false
+
+	if l.mapped.isReady() {
+		l.mapped.commit(l.lines)
 	}
 
 	return
@@ -9,6 +9,8 @@ import (
 )
 
 func TestScanLines(t *testing.T) {
+	scanLines := splitLines('\n')
+
 	// End of file
 	if adv, token, err := scanLines([]byte{}, true); adv != 0 || token != nil || err != nil {
 		t.Errorf("Expected [%v, %v, %v] got [%v, %v, %v]", 0, nil, nil, adv, token, err)
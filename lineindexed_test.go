@@ -6,9 +6,8 @@ package bufpipe_test
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"io"
-	"runtime"
-	"strings"
 	"testing"
 
 	"github.com/Ladbrokes/bufpipe"
@@ -32,7 +31,10 @@ func TestWriteReadIndexedPipe(t *testing.T) {
 	p := bufpipe.NewLineIndexedPipe(data, index)
 
 	testBytes := []byte("\nHello World\n\n")
-	expectIndex := []byte{0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 13, 0, 0, 0, 0, 0, 0, 0}
+	expectIndex := []byte{
+		'B', 'P', 'I', 'X', 1, 0, '\n', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 13, 0, 0, 0, 0, 0, 0, 0,
+	}
 
 	if n, err := p.Write(testBytes); err != nil || n != 14 {
 		t.Errorf("Expected [%v, %v], got [%v, %v]", nil, 14, err, n)
@@ -42,9 +44,9 @@ func TestWriteReadIndexedPipe(t *testing.T) {
 		t.Errorf("Expected [%v, %v], got [%v, %v]", nil, 14, err, n)
 	}
 
-	// 8 bytes * 3 lines
-	if n, err := p.IndexSize(); err != nil || n != 24 {
-		t.Errorf("Expected [%v, %v], got [%v, %v]", nil, 24, err, n)
+	// 32 byte header + 8 bytes * 3 lines
+	if n, err := p.IndexSize(); err != nil || n != 56 {
+		t.Errorf("Expected [%v, %v], got [%v, %v]", nil, 56, err, n)
 	}
 
 	if n, err := p.CountLines(); err != nil || n != 3 {
@@ -76,7 +78,7 @@ func TestWriteReadIndexedPipe(t *testing.T) {
 	}
 
 	index.SeekFunc = unseekableFunc
-	if err := p.SeekLine(1); err != errUnseekable {
+	if err := p.SeekLine(1); !errors.Is(err, errUnseekable) {
 		t.Errorf("Expected %v got %v", errUnseekable, err)
 	}
 
@@ -98,15 +100,15 @@ func TestLateDataSeekFailWriteIndexedPipe(t *testing.T) {
 	p := bufpipe.NewLineIndexedPipe(data, index)
 	data.SeekFunc = unseekableFunc
 
-	if n, err := p.Write(testBytes); n != 0 || err != errUnseekable {
+	if n, err := p.Write(testBytes); n != 0 || !errors.Is(err, errUnseekable) {
 		t.Errorf("Expected [%v, %v] got [%v, %v]", 0, errUnseekable, n, err)
 	}
 
 	data.SeekFunc = nil
-	if n, err := p.Read(testBytes); n != 0 || err != errUnseekable {
+	if n, err := p.Read(testBytes); n != 0 || !errors.Is(err, errUnseekable) {
 		t.Errorf("Expected [%v, %v] got [%v, %v]", 0, errUnseekable, n, err)
 	}
-	if n, err := p.Write(testBytes); n != 0 || err != errUnseekable {
+	if n, err := p.Write(testBytes); n != 0 || !errors.Is(err, errUnseekable) {
 		t.Errorf("Expected [%v, %v] got [%v, %v]", 0, errUnseekable, n, err)
 	}
 }
@@ -118,7 +120,7 @@ func TestLateIndexSeekFailWriteIndexedPipe(t *testing.T) {
 	p := bufpipe.NewLineIndexedPipe(data, index)
 	index.SeekFunc = unseekableFunc
 
-	if n, err := p.Write(testBytes); n != 0 || err != errUnseekable {
+	if n, err := p.Write(testBytes); n != 0 || !errors.Is(err, errUnseekable) {
 		t.Errorf("Expected [%v, %v] got [%v, %v]", 0, errUnseekable, n, err)
 	}
 
@@ -135,7 +137,7 @@ func TestIndexWriteFailureIndexedPipe(t *testing.T) {
 	p := bufpipe.NewLineIndexedPipe(data, index)
 	index.WriteFunc = unwriteableFunc
 
-	if n, err := p.Write(testBytes); n != 0 || err != io.ErrUnexpectedEOF {
+	if n, err := p.Write(testBytes); n != 0 || !errors.Is(err, io.ErrUnexpectedEOF) {
 		t.Errorf("Expected [%v, %v] got [%v, %v]", 0, io.ErrUnexpectedEOF, n, err)
 	}
 }
@@ -149,11 +151,42 @@ func TestIndexSyncFailureIndexedPipe(t *testing.T) {
 		return io.ErrUnexpectedEOF
 	}
 
-	if n, err := p.Write(testBytes); n != 0 || err != io.ErrUnexpectedEOF {
+	if n, err := p.Write(testBytes); n != 0 || !errors.Is(err, io.ErrUnexpectedEOF) {
 		t.Errorf("Expected [%v, %v] got [%v, %v]", 0, io.ErrUnexpectedEOF, n, err)
 	}
 }
 
+func TestIndexDataReadFailureIndexedPipe(t *testing.T) {
+	data := &mock.ReadWriteSeekable{}
+	index := &mock.ReadWriteSeekable{}
+	p, _ := bufpipe.OpenLineIndexedStoragePipe(bufpipe.NewStorage(data), bufpipe.NewStorage(index),
+		bufpipe.WithChecksums(bufpipe.NewMemoryStorage()))
+	p.Write([]byte("Hel"))
+
+	// Checksumming a line started by an earlier write reads it back from the data
+	errUnreadable := errors.New("unreadable")
+	data.ReadFunc = func(rws *mock.ReadWriteSeekable, b []byte) (int, error) {
+		return 0, errUnreadable
+	}
+	if n, err := p.Write([]byte("lo\n")); n != 0 || !errors.Is(err, errUnreadable) {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 0, errUnreadable, n, err)
+	}
+
+	data.ReadFunc = nil
+	if err := p.Recover(); err != nil {
+		t.Fatal("Unable to recover", err)
+	}
+	if n, err := p.Write([]byte("World\n")); n != 6 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 6, nil, n, err)
+	}
+	if lines, err := p.Verify(); lines != nil || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", nil, nil, lines, err)
+	}
+	if n, err := p.CountLines(); n != 2 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 2, nil, n, err)
+	}
+}
+
 func TestLateDataWriteFailIndexedPipe(t *testing.T) {
 	testBytes := []byte("\nHello World\n\n")
 	data := &mock.ReadWriteSeekable{}
@@ -161,28 +194,29 @@ func TestLateDataWriteFailIndexedPipe(t *testing.T) {
 	p := bufpipe.NewLineIndexedPipe(data, index)
 	data.WriteFunc = unwriteableFunc
 
-	if n, err := p.Write(testBytes); n != 0 || err != io.ErrUnexpectedEOF {
+	if n, err := p.Write(testBytes); n != 0 || !errors.Is(err, io.ErrUnexpectedEOF) {
 		t.Errorf("Expected [%v, %v] got [%v, %v]", 0, io.ErrUnexpectedEOF, n, err)
 	}
 }
 
-func TestIndexExtremeEdgeCaseFailureIndexedPipe(t *testing.T) {
-	testBytes := []byte("\nHello World\n\n")
+func TestReopenIndexedPipe(t *testing.T) {
 	data := &mock.ReadWriteSeekable{}
 	index := &mock.ReadWriteSeekable{}
 	p := bufpipe.NewLineIndexedPipe(data, index)
 
-	data.SeekFunc = func(rws *mock.ReadWriteSeekable, offset int64, whence int) (int64, error) {
-		fpcs := make([]uintptr, 1)
-		runtime.Callers(3, fpcs)
-		fun := runtime.FuncForPC(fpcs[0] - 1)
-		if strings.HasSuffix(fun.Name(), "writeIndex") {
-			return 0, errUnseekable
-		}
-		return 0, nil
+	writeNumberedLines(t, p, 0, 15)
+
+	// Lose the index entries of the last 5 lines
+	p = bufpipe.NewLineIndexedPipe(mock.NewReadWriteSeekable(data.Bytes()), mock.NewReadWriteSeekable(index.Bytes()[:32+10*8]))
+	if n, err := p.CountLines(); n != 15 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 15, nil, n, err)
 	}
 
-	if n, err := p.Write(testBytes); n != 0 || err != errUnseekable {
-		t.Errorf("Expected [%v, %v] got [%v, %v]", 0, errUnseekable, n, err)
+	writeNumberedLines(t, p, 15, 20)
+
+	if n, err := p.IndexSize(); n != 32+20*8 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 32+20*8, nil, n, err)
 	}
+
+	testSeekLines(t, p, 20)
 }
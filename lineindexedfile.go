@@ -4,7 +4,6 @@
 package bufpipe
 
 import (
-	"io"
 	"os"
 )
 
@@ -13,6 +12,10 @@ type LineIndexedFilePipe struct {
 	*LineIndexedPipe
 	data  string
 	index string
+	times string
+	sums  string
+	chain string
+	tree  string
 }
 
 // NewLineIndexedFilePipe will create and return a LineIndexedFilePipe based around the given
@@ -20,33 +23,155 @@ type LineIndexedFilePipe struct {
 // The files will be created if required with the given permissions, if the files already exist
 // they will be opened for appending.
 func NewLineIndexedFilePipe(data, index string, perm os.FileMode) (*LineIndexedFilePipe, error) {
-	var err error
+	return OpenLineIndexedFilePipe(data, index, perm)
+}
+
+// NewLineTimeIndexedFilePipe is NewLineIndexedFilePipe with the addition of a time index
+// stored in the times filename, see NewLineTimeIndexedPipe.
+func NewLineTimeIndexedFilePipe(data, index, times string, perm os.FileMode) (*LineIndexedFilePipe, error) {
+	return OpenLineIndexedFilePipe(data, index, perm, WithTimeIndexFile(times))
+}
+
+// NewMappedLineIndexedFilePipe is NewLineIndexedFilePipe with lookups served from a memory mapping
+// of the index, so SeekLine, CountLines and IndexSize do not read the index file or wait on
+// writers to look up a line. Only indexes with an entry for every line are mapped, and only on
+// Linux, otherwise the index is read as normal.
+func NewMappedLineIndexedFilePipe(data, index string, perm os.FileMode) (*LineIndexedFilePipe, error) {
+	return OpenLineIndexedFilePipe(data, index, perm, WithMemoryMap())
+}
+
+// OpenLineIndexedFilePipeReadOnly opens existing data and index files read only, see WithReadOnly.
+// The pipe can be read and its lines sought and counted, writes fail with ErrReadOnly. Lines
+// missing from the index, as left by a writer that stopped part way, are found by reading the
+// data rather than added to the index. Space preallocated by an open writer is left out, see
+// WithPreallocate.
+func OpenLineIndexedFilePipeReadOnly(data, index string, opts ...Option) (*LineIndexedFilePipe, error) {
+	return OpenLineIndexedFilePipe(data, index, 0, append(opts, WithReadOnly())...)
+}
+
+// OpenLineIndexedFilePipe is NewLineIndexedFilePipe configured by opts, the index is read before
+// returning, see OpenLineIndexedPipe. Unless opened read only, the data file is locked against
+// other writers until Close and ErrLocked is returned if another writer has it open.
+func OpenLineIndexedFilePipe(data, index string, perm os.FileMode, opts ...Option) (*LineIndexedFilePipe, error) {
+	o := newOptions(opts)
 	l := &LineIndexedFilePipe{
 		data:  data,
 		index: index,
+		times: o.timesName,
+		sums:  o.sumsName,
+		chain: o.chainName,
+		tree:  o.treeName,
+	}
+
+	if o.follow {
+		o.readOnly = true
+	}
+	flag, recordsFlag := os.O_APPEND|os.O_CREATE|os.O_RDWR, os.O_APPEND|os.O_CREATE|os.O_RDWR
+	if o.readOnly {
+		o.prealloc = 0
+		flag, recordsFlag = os.O_RDONLY, os.O_RDONLY
+	} else if o.prealloc > 0 {
+		// Preallocated files are written at the end of what has been written, not of the file
+		flag = os.O_CREATE | os.O_RDWR
 	}
 
 	var dataFile, indexFile *os.File
-	if dataFile, err = os.OpenFile(data, os.O_APPEND|os.O_CREATE|os.O_RDWR, perm); err != nil {
+	var err error
+	if dataFile, err = os.OpenFile(data, flag, perm); err != nil {
 		return nil, err
 	}
+	if !o.readOnly {
+		if err = lockFile(dataFile); err != nil {
+			dataFile.Close()
+			return nil, err
+		}
+	}
 
-	if indexFile, err = os.OpenFile(index, os.O_APPEND|os.O_CREATE|os.O_RDWR, perm); err != nil {
+	if indexFile, err = os.OpenFile(index, flag, perm); err != nil {
 		dataFile.Close()
 		return nil, err
 	}
 
-	l.LineIndexedPipe = NewLineIndexedPipe(dataFile, indexFile)
+	var dataStorage, indexStorage Storage
+	if o.readOnly {
+		// Another process may be writing the files with space preallocated
+		dataStorage = newPreallocatedFile(dataFile, indexFile, 0)
+		indexStorage = newPreallocatedFile(indexFile, indexFile, indexHeaderSize)
+	} else {
+		dataStorage, indexStorage = NewFileStorage(dataFile), NewFileStorage(indexFile)
+	}
 
-	return l, nil
-}
+	var preallocData, preallocIndex *preallocStorage
+	var dirty bool
+	if o.prealloc > 0 {
+		if preallocData, preallocIndex, dirty, err = preallocate(dataFile, indexFile, o); err != nil {
+			dataFile.Close()
+			indexFile.Close()
+			return nil, err
+		}
+		dataStorage, indexStorage = preallocData, preallocIndex
+	}
+
+	// The optional records of each line are opened as the index is
+	records := []struct {
+		name    string
+		storage *Storage
+	}{
+		{o.timesName, &o.times},
+		{o.sumsName, &o.sums},
+		{o.chainName, &o.chain},
+		{o.treeName, &o.tree},
+	}
+	var opened []Storage
+	closeRecords := func() {
+		for _, s := range opened {
+			s.Close()
+		}
+	}
+	for _, r := range records {
+		if r.name == "" {
+			continue
+		}
+		var f *os.File
+		if f, err = os.OpenFile(r.name, recordsFlag, perm); err != nil {
+			dataFile.Close()
+			indexFile.Close()
+			closeRecords()
+			return nil, err
+		}
+		*r.storage = NewFileStorage(f)
+		opened = append(opened, *r.storage)
+	}
+
+	if l.LineIndexedPipe, err = openLineIndexedPipe(dataStorage, indexStorage, o); err != nil {
+		dataFile.Close()
+		indexFile.Close()
+		closeRecords()
+		return nil, err
+	}
+
+	// Load now so errors are returned here, and the mapping is in use from the first lookup
+	if _, err = l.CountLines(); err != nil {
+		l.Close()
+		return nil, err
+	}
 
-// Close closes the Pipe, rendering then unusable for I/O. It returns an error, if any.
-func (l *LineIndexedFilePipe) Close() error {
-	l.LineIndexedPipe.data.(io.Closer).Close()
-	l.LineIndexedPipe.index.(io.Closer).Close()
+	if o.prealloc > 0 {
+		if err = l.openPreallocated(preallocData, preallocIndex, dirty); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
 
-	l.LineIndexedPipe.close()
+	if o.follow {
+		names := []string{data, index}
+		for _, r := range records {
+			if r.name != "" {
+				names = append(names, r.name)
+			}
+		}
+		l.follow(names, o.poll, l.refresh)
+	}
 
-	return nil
+	return l, nil
 }
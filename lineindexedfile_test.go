@@ -4,8 +4,10 @@
 package bufpipe_test
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
+	"strings"
 	"syscall"
 	"testing"
 
@@ -28,7 +30,14 @@ func TestNewLineIndexedFilePipe(t *testing.T) {
 		t.Error("Unable to create IndexedFile object", err)
 	}
 
-	p.Close()
+	if err := p.Close(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	// Both files report being closed already
+	if err := p.Close(); !errors.Is(err, os.ErrClosed) || strings.Count(err.Error(), os.ErrClosed.Error()) != 2 {
+		t.Errorf("Expected %v twice got %v", os.ErrClosed, err)
+	}
 
 	os.Remove(data.Name())
 	os.Remove(index.Name())
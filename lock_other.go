@@ -0,0 +1,16 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package bufpipe
+
+import (
+	"os"
+)
+
+// lockFile does nothing where flock is not available
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/Ladbrokes/bufpipe"
+)
+
+func TestWriterLock(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("flock is not available")
+	}
+
+	dir, err := ioutil.TempDir("", "testlock")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, index := filepath.Join(dir, "data"), filepath.Join(dir, "index")
+	w, err := bufpipe.OpenLineIndexedFilePipe(data, index, 0666)
+	if err != nil {
+		t.Fatal("Unable to open pipe", err)
+	}
+	writeNumberedLines(t, w, 0, 3)
+
+	if _, err := bufpipe.OpenLineIndexedFilePipe(data, index, 0666); !errors.Is(err, bufpipe.ErrLocked) {
+		t.Errorf("Expected %v got %v", bufpipe.ErrLocked, err)
+	}
+	if _, err := bufpipe.OpenFilePipe(data, 0666); !errors.Is(err, bufpipe.ErrLocked) {
+		t.Errorf("Expected %v got %v", bufpipe.ErrLocked, err)
+	}
+
+	// Readers do not need the lock
+	r, err := bufpipe.OpenLineIndexedFilePipe(data, index, 0666, bufpipe.WithReadOnly())
+	if err != nil {
+		t.Fatal("Unable to open pipe read only", err)
+	}
+	if lines, err := r.CountLines(); err != nil || lines != 3 {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", nil, 3, err, lines)
+	}
+	if _, err := r.Write([]byte("line 3\n")); err != bufpipe.ErrReadOnly {
+		t.Errorf("Expected %v got %v", bufpipe.ErrReadOnly, err)
+	}
+	r.Close()
+
+	// The lock is released by Close
+	w.Close()
+	if w, err = bufpipe.OpenLineIndexedFilePipe(data, index, 0666); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	} else {
+		w.Close()
+	}
+
+	// Read only pipes do not create files
+	if _, err := bufpipe.OpenFilePipe(filepath.Join(dir, "missing"), 0666, bufpipe.WithReadOnly()); !os.IsNotExist(err) {
+		t.Errorf("Expected not exist got %v", err)
+	}
+}
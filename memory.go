@@ -0,0 +1,191 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrStorageFull is returned when appending more than a storage has capacity for
+var ErrStorageFull = errors.New("storage is full")
+
+// ErrReleased is returned when reading data that has already been released
+var ErrReleased = errors.New("data has been released")
+
+// Releaser is implemented by Storage that can discard data once it has been read. Pipes
+// release everything before their read position whenever no reads are in progress.
+type Releaser interface {
+	Release(offset int64)
+}
+
+const memoryChunkSize = 32 * 1024
+
+// MemoryStorage is Storage held in memory as a list of fixed size chunks, so appending never
+// copies what is already held. It is safe for concurrent use.
+type MemoryStorage struct {
+	mu sync.RWMutex // protects remaining fields
+
+	chunks [][]byte // the first starts at offset first
+	spare  []byte   // a released chunk kept for reuse
+	first  int64
+	size   int64
+
+	capacity  int64 // most bytes held at once, 0 for no limit
+	releasing bool
+}
+
+// NewMemoryStorage returns Storage held in memory that keeps everything appended to it
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{}
+}
+
+// NewBufferStorage returns Storage held in memory for use as a buffer. Chunks are released
+// once a pipe has read past them, after which they can not be read again, and appends that
+// would hold more than capacity bytes fail with ErrStorageFull. A capacity of 0 is unlimited.
+func NewBufferStorage(capacity int64) *MemoryStorage {
+	return &MemoryStorage{
+		capacity:  capacity,
+		releasing: true,
+	}
+}
+
+// ReadAt implements the io.ReaderAt interface
+func (s *MemoryStorage) ReadAt(p []byte, off int64) (n int, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if off < s.first {
+		return 0, ErrReleased
+	}
+
+	for n < len(p) && off < s.size {
+		i, o := s.locate(off)
+		chunk := s.chunks[i][o:]
+		if remaining := s.size - off; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		c := copy(p[n:], chunk)
+		n += c
+		off += int64(c)
+	}
+
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+// Append implements the Storage interface, p is appended whole or not at all
+func (s *MemoryStorage) Append(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.capacity > 0 && s.size-s.first+int64(len(p)) > s.capacity {
+		return 0, ErrStorageFull
+	}
+
+	for d := p; len(d) > 0; {
+		i, o := s.locate(s.size)
+		if i == len(s.chunks) {
+			chunk := s.spare
+			if s.spare = nil; chunk == nil {
+				chunk = make([]byte, memoryChunkSize)
+			}
+			s.chunks = append(s.chunks, chunk)
+		}
+		c := copy(s.chunks[i][o:], d)
+		s.size += int64(c)
+		d = d[c:]
+	}
+
+	return len(p), nil
+}
+
+// Size implements the Storage interface
+func (s *MemoryStorage) Size() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.size, nil
+}
+
+// Truncate implements the Storage interface, chunks past the new size are freed
+func (s *MemoryStorage) Truncate(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case size < s.first:
+		return ErrReleased
+	case size >= s.size:
+		return nil
+	}
+
+	s.size = size
+	i, o := s.locate(size)
+	if o > 0 {
+		i++
+	}
+	for j := i; j < len(s.chunks); j++ {
+		s.chunks[j] = nil
+	}
+	s.chunks = s.chunks[:i]
+
+	return nil
+}
+
+// Release frees the chunks wholly before offset, if created by NewBufferStorage
+func (s *MemoryStorage) Release(offset int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.releasing || offset <= s.first {
+		return
+	}
+	if offset > s.size {
+		offset = s.size
+	}
+
+	i, _ := s.locate(offset)
+	if i == 0 {
+		return
+	}
+	s.spare = s.chunks[0]
+	for j := 0; j < i; j++ {
+		s.chunks[j] = nil
+	}
+	s.chunks = s.chunks[i:]
+	s.first += int64(i) * memoryChunkSize
+}
+
+// releasedTo returns the offset before which everything has been released
+func (s *MemoryStorage) releasedTo() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.first
+}
+
+// Sync implements the Storage interface, there is nothing to do
+func (s *MemoryStorage) Sync() error {
+	return nil
+}
+
+// Close implements the Storage interface, freeing all chunks
+func (s *MemoryStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.chunks, s.spare = nil, nil
+	s.first = s.size
+	return nil
+}
+
+// locate returns the chunk and the position within it of offset
+func (s *MemoryStorage) locate(offset int64) (int, int) {
+	offset -= s.first
+	return int(offset / memoryChunkSize), int(offset % memoryChunkSize)
+}
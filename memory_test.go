@@ -0,0 +1,152 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/Ladbrokes/bufpipe"
+)
+
+func pattern(size int) []byte {
+	p := make([]byte, size)
+	for i := range p {
+		p[i] = byte(i % 251)
+	}
+	return p
+}
+
+func TestMemoryStorageChunks(t *testing.T) {
+	s := bufpipe.NewMemoryStorage()
+	expect := pattern(100000)
+
+	// Uneven appends spanning several chunks
+	for d := expect; len(d) > 0; {
+		c := 7777
+		if c > len(d) {
+			c = len(d)
+		}
+		s.Append(d[:c])
+		d = d[c:]
+	}
+
+	got := make([]byte, len(expect))
+	if n, err := s.ReadAt(got, 0); n != len(expect) || (err != nil && err != io.EOF) || !bytes.Equal(expect, got) {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", len(expect), nil, n, err)
+	}
+
+	if err := s.Truncate(40000); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	s.Append(expect[40000:])
+	if n, err := s.ReadAt(got, 0); n != len(expect) || (err != nil && err != io.EOF) || !bytes.Equal(expect, got) {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", len(expect), nil, n, err)
+	}
+
+	// Kept for seeking back to
+	s.Release(len64(expect))
+	if n, err := s.ReadAt(got[:10], 0); n != 10 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 10, nil, n, err)
+	}
+}
+
+func len64(p []byte) int64 {
+	return int64(len(p))
+}
+
+func TestBufferStoragePipe(t *testing.T) {
+	s := bufpipe.NewBufferStorage(64 * 1024)
+	p := bufpipe.NewStoragePipe(s)
+	expect := pattern(48 * 1024)
+
+	if n, err := p.Write(expect); n != len(expect) || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", len(expect), nil, n, err)
+	}
+
+	// Over capacity until read
+	if n, err := s.Append(expect); n != 0 || err != bufpipe.ErrStorageFull {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 0, bufpipe.ErrStorageFull, n, err)
+	}
+
+	got := make([]byte, len(expect))
+	if _, err := io.ReadFull(p, got); err != nil || !bytes.Equal(expect, got) {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	// The first chunk has been read and released
+	if n, err := s.ReadAt(got, 0); n != 0 || err != bufpipe.ErrReleased {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 0, bufpipe.ErrReleased, n, err)
+	}
+
+	if n, err := p.Write(expect); n != len(expect) || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", len(expect), nil, n, err)
+	}
+	if _, err := io.ReadFull(p, got); err != nil || !bytes.Equal(expect, got) {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	if err := s.Truncate(0); err != bufpipe.ErrReleased {
+		t.Errorf("Expected %v got %v", bufpipe.ErrReleased, err)
+	}
+
+	// Seeking back to released data fails the read
+	p.Seek(0, os.SEEK_SET)
+	if _, err := p.Read(got); !errors.Is(err, bufpipe.ErrReleased) {
+		t.Errorf("Expected %v got %v", bufpipe.ErrReleased, err)
+	}
+}
+
+const benchmarkBlock = 1024
+
+func BenchmarkBufferStoragePipe(b *testing.B) {
+	p := bufpipe.NewStoragePipe(bufpipe.NewBufferStorage(0))
+	block := pattern(benchmarkBlock)
+	d := make([]byte, benchmarkBlock)
+
+	b.SetBytes(benchmarkBlock)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.Write(block)
+		io.ReadFull(p, d)
+	}
+}
+
+func BenchmarkBytesBuffer(b *testing.B) {
+	var buf bytes.Buffer
+	block := pattern(benchmarkBlock)
+	d := make([]byte, benchmarkBlock)
+
+	b.SetBytes(benchmarkBlock)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Write(block)
+		io.ReadFull(&buf, d)
+	}
+}
+
+func BenchmarkMemoryStorageAppend(b *testing.B) {
+	s := bufpipe.NewMemoryStorage()
+	block := pattern(benchmarkBlock)
+
+	b.SetBytes(benchmarkBlock)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Append(block)
+	}
+}
+
+func BenchmarkBytesBufferAppend(b *testing.B) {
+	var buf bytes.Buffer
+	block := pattern(benchmarkBlock)
+
+	b.SetBytes(benchmarkBlock)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Write(block)
+	}
+}
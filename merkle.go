@@ -0,0 +1,397 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe
+
+import (
+	"crypto/sha256"
+	"errors"
+	"math/bits"
+	"sort"
+)
+
+var (
+	// ErrNoMerkleTree is returned when a Merkle tree operation is used on a pipe without one
+	ErrNoMerkleTree = errors.New("pipe has no merkle tree")
+	// ErrTreeSize is returned when a proof is asked of lines that are not in the tree
+	ErrTreeSize = errors.New("lines are not in the merkle tree")
+	// ErrProof is returned when a proof does not verify
+	ErrProof = errors.New("merkle proof does not verify")
+)
+
+// Root returns the number of lines in the Merkle tree and the hash at its root, see RootAt
+func (l *LineIndexedPipe) Root() (size int64, root [hashSize]byte, err error) {
+	err = l.withTree(func(lines int64) (err error) {
+		size = lines
+		root, err = l.subtreeHash(0, size)
+		return
+	})
+	return
+}
+
+// RootAt returns the hash at the root of the Merkle tree of the first size lines. Leaves are
+// the lines including their delimiter, hashed as RFC 6962 describes, see LeafHash.
+func (l *LineIndexedPipe) RootAt(size int64) (root [hashSize]byte, err error) {
+	err = l.withTree(func(lines int64) (err error) {
+		if size < 0 || size > lines {
+			return ErrTreeSize
+		}
+		root, err = l.subtreeHash(0, size)
+		return
+	})
+	return
+}
+
+// InclusionProof returns the RFC 6962 audit path showing line n is in the tree of the first size
+// lines, see VerifyInclusion
+func (l *LineIndexedPipe) InclusionProof(n, size int64) (proof [][hashSize]byte, err error) {
+	err = l.withTree(func(lines int64) (err error) {
+		if n < 0 || n >= size || size > lines {
+			return ErrTreeSize
+		}
+		proof, err = l.inclusionProof(n, 0, size)
+		return
+	})
+	return
+}
+
+// ConsistencyProof returns the RFC 6962 proof that the tree of the first oldSize lines is the
+// start of the tree of the first newSize lines, see VerifyConsistency
+func (l *LineIndexedPipe) ConsistencyProof(oldSize, newSize int64) (proof [][hashSize]byte, err error) {
+	err = l.withTree(func(lines int64) (err error) {
+		if oldSize <= 0 || oldSize > newSize || newSize > lines {
+			return ErrTreeSize
+		}
+		if oldSize < newSize {
+			proof, err = l.consistencyProof(oldSize, 0, newSize, true)
+		}
+		return
+	})
+	return
+}
+
+// LeafHash returns the hash of a line as a leaf of the Merkle tree
+func LeafHash(line []byte) (h [hashSize]byte) {
+	d := sha256.New()
+	d.Write([]byte{0})
+	d.Write(line)
+	d.Sum(h[:0])
+	return
+}
+
+// VerifyInclusion checks proof shows line, including its delimiter, is line n of the tree of
+// size lines with the given root
+func VerifyInclusion(line []byte, n, size int64, proof [][hashSize]byte, root [hashSize]byte) error {
+	if n < 0 || n >= size {
+		return ErrProof
+	}
+
+	fn, sn, r := n, size-1, LeafHash(line)
+	for _, p := range proof {
+		if sn == 0 {
+			return ErrProof
+		}
+		if fn&1 == 1 || fn == sn {
+			r = nodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn, sn = fn>>1, sn>>1
+			}
+		} else {
+			r = nodeHash(r, p)
+		}
+		fn, sn = fn>>1, sn>>1
+	}
+
+	if sn != 0 || r != root {
+		return ErrProof
+	}
+	return nil
+}
+
+// VerifyConsistency checks proof shows the tree of oldSize lines with oldRoot is the start of
+// the tree of newSize lines with newRoot
+func VerifyConsistency(oldSize, newSize int64, proof [][hashSize]byte, oldRoot, newRoot [hashSize]byte) error {
+	switch {
+	case oldSize <= 0 || oldSize > newSize:
+		return ErrProof
+	case oldSize == newSize:
+		if len(proof) != 0 || oldRoot != newRoot {
+			return ErrProof
+		}
+		return nil
+	}
+
+	// A complete old tree is a subtree of the new one and not in the proof
+	if oldSize&(oldSize-1) == 0 {
+		proof = append([][hashSize]byte{oldRoot}, proof...)
+	}
+	if len(proof) == 0 {
+		return ErrProof
+	}
+
+	fn, sn := oldSize-1, newSize-1
+	for fn&1 == 1 {
+		fn, sn = fn>>1, sn>>1
+	}
+
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return ErrProof
+		}
+		if fn&1 == 1 || fn == sn {
+			fr, sr = nodeHash(c, fr), nodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn, sn = fn>>1, sn>>1
+			}
+		} else {
+			sr = nodeHash(sr, c)
+		}
+		fn, sn = fn>>1, sn>>1
+	}
+
+	if sn != 0 || fr != oldRoot || sr != newRoot {
+		return ErrProof
+	}
+	return nil
+}
+
+// withTree calls fn with the write lock held and the number of lines in the tree
+func (l *LineIndexedPipe) withTree(fn func(lines int64) error) error {
+	if l.tree == nil {
+		return ErrNoMerkleTree
+	}
+
+	l.wl.Lock()
+	defer l.wl.Unlock()
+
+	if err := l.verifiable(); err != nil {
+		return err
+	}
+
+	// Lines written without the tree are not in it until the next write adds them
+	size, err := l.tree.Size()
+	if err != nil {
+		return pipeError("size", "tree", err)
+	}
+
+	return fn(treeLines(size/hashSize, l.lines))
+}
+
+// inclusionProof returns the audit path of line n in the tree of lines lo to hi
+func (l *LineIndexedPipe) inclusionProof(n, lo, hi int64) (proof [][hashSize]byte, err error) {
+	if hi-lo == 1 {
+		return nil, nil
+	}
+
+	var h [hashSize]byte
+	k := splitTree(hi - lo)
+	if n < lo+k {
+		if proof, err = l.inclusionProof(n, lo, lo+k); err != nil {
+			return
+		}
+		h, err = l.subtreeHash(lo+k, hi)
+	} else {
+		if proof, err = l.inclusionProof(n, lo+k, hi); err != nil {
+			return
+		}
+		h, err = l.subtreeHash(lo, lo+k)
+	}
+
+	return append(proof, h), err
+}
+
+// consistencyProof returns the proof that the first size lines of the tree of lines lo to hi
+// are a tree of their own, complete is whether that tree is the one the proof is of
+func (l *LineIndexedPipe) consistencyProof(size, lo, hi int64, complete bool) (proof [][hashSize]byte, err error) {
+	var h [hashSize]byte
+	if size == hi-lo {
+		if complete {
+			return nil, nil
+		}
+		h, err = l.subtreeHash(lo, hi)
+		return [][hashSize]byte{h}, err
+	}
+
+	k := splitTree(hi - lo)
+	if size <= k {
+		if proof, err = l.consistencyProof(size, lo, lo+k, complete); err != nil {
+			return
+		}
+		h, err = l.subtreeHash(lo+k, hi)
+	} else {
+		if proof, err = l.consistencyProof(size-k, lo+k, hi, false); err != nil {
+			return
+		}
+		h, err = l.subtreeHash(lo, lo+k)
+	}
+
+	return append(proof, h), err
+}
+
+// subtreeHash returns the hash of the tree of lines lo to hi. Complete subtrees are stored, the
+// rest are found from them.
+func (l *LineIndexedPipe) subtreeHash(lo, hi int64) (h [hashSize]byte, err error) {
+	n := hi - lo
+	if n == 0 {
+		return sha256.Sum256(nil), nil
+	}
+
+	if n&(n-1) == 0 && lo%n == 0 {
+		level := bits.TrailingZeros64(uint64(n))
+		err = pipeError("read", "tree", readAt(l.tree, storedHashIndex(level, lo>>level)*hashSize, &h))
+		return
+	}
+
+	k := splitTree(n)
+	left, err := l.subtreeHash(lo, lo+k)
+	if err != nil {
+		return
+	}
+	right, err := l.subtreeHash(lo+k, hi)
+	if err != nil {
+		return
+	}
+
+	return nodeHash(left, right), nil
+}
+
+// writeLeaf records the hash of the line that has been completed in the tree, tail is the end of
+// it that has just been written and next is where the following line starts
+func (l *LineIndexedPipe) writeLeaf(line int64, tail []byte, next int64) (err error) {
+	if !l.treeRead {
+		if err = l.loadTree(line); err != nil {
+			return
+		}
+	}
+
+	h := sha256.New()
+	h.Write([]byte{0})
+	if next-int64(len(tail)) == l.lastIndex {
+		h.Write(tail)
+	} else if err = l.hashData(h, l.lastIndex, next); err != nil {
+		return
+	}
+
+	var leaf [hashSize]byte
+	h.Sum(leaf[:0])
+	if err = l.appendLeaf(line, leaf); err != nil {
+		return
+	}
+
+	return pipeError("sync", "tree", l.syncData(l.tree))
+}
+
+// appendLeaf stores the hash of line n and of the subtrees it completes
+func (l *LineIndexedPipe) appendLeaf(n int64, leaf [hashSize]byte) error {
+	buf := append(make([]byte, 0, hashSize), leaf[:]...)
+	h := leaf
+	for level := 0; n>>level&1 == 1; level++ {
+		var left [hashSize]byte
+		if err := readAt(l.tree, storedHashIndex(level, n>>level-1)*hashSize, &left); err != nil {
+			return pipeError("read", "tree", err)
+		}
+		h = nodeHash(left, h)
+		buf = append(buf, h[:]...)
+	}
+
+	_, err := l.tree.Append(buf)
+	return pipeError("write", "tree", err)
+}
+
+// loadTree has the tree end at line, dropping any hashes stored for it by a failed index write
+// and adding the lines written without them
+func (l *LineIndexedPipe) loadTree(line int64) (err error) {
+	size, err := l.tree.Size()
+	if err != nil {
+		return pipeError("size", "tree", err)
+	}
+
+	have := treeLines(size/hashSize, line)
+	if stored := storedHashCount(have) * hashSize; size != stored {
+		if err = l.tree.Truncate(stored); err != nil {
+			return pipeError("truncate", "tree", err)
+		}
+	}
+
+	if have < line {
+		var start int64
+		if start, err = l.lineOffset(have); err != nil {
+			return
+		}
+		var leafErr error
+		err = l.scanData(start, l.lastIndex, func(end int64) bool {
+			h := sha256.New()
+			h.Write([]byte{0})
+			if leafErr = l.hashData(h, start, end); leafErr != nil {
+				return false
+			}
+			var leaf [hashSize]byte
+			h.Sum(leaf[:0])
+			if leafErr = l.appendLeaf(have, leaf); leafErr != nil {
+				return false
+			}
+			have++
+			start = end
+			return true
+		})
+		if err != nil {
+			return
+		}
+		if leafErr != nil {
+			return leafErr
+		}
+	}
+	l.treeRead = true
+
+	return
+}
+
+// treeLines returns the number of lines, up to max, with all their hashes in count stored hashes
+func treeLines(count, max int64) int64 {
+	return int64(sort.Search(int(max), func(n int) bool {
+		return storedHashCount(int64(n)+1) > count
+	}))
+}
+
+// splitTree returns the largest power of two less than n, where RFC 6962 splits a tree of n lines
+func splitTree(n int64) int64 {
+	return 1 << (bits.Len64(uint64(n-1)) - 1)
+}
+
+// nodeHash returns the hash of the subtree with children left and right
+func nodeHash(left, right [hashSize]byte) [hashSize]byte {
+	var b [1 + 2*hashSize]byte
+	b[0] = 1
+	copy(b[1:], left[:])
+	copy(b[1+hashSize:], right[:])
+	return sha256.Sum256(b[:])
+}
+
+// storedHashIndex returns where the hash of the n'th complete subtree of 2^level lines is
+// stored. Each line's leaf hash is stored followed by the hashes of the subtrees it completes,
+// so the tree is only ever appended to.
+func storedHashIndex(level int, n int64) int64 {
+	// The n'th hash of a level follows the 2n+1'th of the level below
+	for i := level; i > 0; i-- {
+		n = 2*n + 1
+	}
+	// Leaf n follows n leaves and the n/2 + n/4 + ... subtrees they complete
+	var i int64
+	for ; n > 0; n >>= 1 {
+		i += n
+	}
+	return i + int64(level)
+}
+
+// storedHashCount returns the number of hashes stored for a tree of n lines
+func storedHashCount(n int64) int64 {
+	if n == 0 {
+		return 0
+	}
+	count := storedHashIndex(0, n-1) + 1
+	for i := uint64(n - 1); i&1 != 0; i >>= 1 {
+		count++
+	}
+	return count
+}
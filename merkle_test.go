@@ -0,0 +1,154 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe_test
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Ladbrokes/bufpipe"
+	"github.com/Ladbrokes/bufpipe/mock"
+)
+
+// treeHash is the RFC 6962 Merkle tree hash of lines
+func treeHash(lines []string) [sha256.Size]byte {
+	switch len(lines) {
+	case 0:
+		return sha256.Sum256(nil)
+	case 1:
+		return bufpipe.LeafHash([]byte(lines[0]))
+	}
+
+	k := 1
+	for k*2 < len(lines) {
+		k *= 2
+	}
+	left, right := treeHash(lines[:k]), treeHash(lines[k:])
+	return sha256.Sum256(append(append([]byte{1}, left[:]...), right[:]...))
+}
+
+func TestNoMerkleTreePipe(t *testing.T) {
+	p := bufpipe.NewLineIndexedPipe(&mock.ReadWriteSeekable{}, &mock.ReadWriteSeekable{})
+
+	if _, _, err := p.Root(); err != bufpipe.ErrNoMerkleTree {
+		t.Errorf("Expected %v got %v", bufpipe.ErrNoMerkleTree, err)
+	}
+	if _, err := p.InclusionProof(0, 1); err != bufpipe.ErrNoMerkleTree {
+		t.Errorf("Expected %v got %v", bufpipe.ErrNoMerkleTree, err)
+	}
+}
+
+func TestMerkleTree(t *testing.T) {
+	p, err := bufpipe.OpenLineIndexedStoragePipe(bufpipe.NewMemoryStorage(), bufpipe.NewMemoryStorage(),
+		bufpipe.WithMerkleTree(bufpipe.NewMemoryStorage()))
+	if err != nil {
+		t.Fatal("Unable to create pipe", err)
+	}
+	defer p.Close()
+
+	if size, root, err := p.Root(); size != 0 || root != treeHash(nil) || err != nil {
+		t.Errorf("Expected [%v, %x, %v] got [%v, %x, %v]", 0, treeHash(nil), nil, size, root, err)
+	}
+
+	var lines []string
+	for i := 0; i < 13; i++ {
+		lines = append(lines, fmt.Sprintf("line %d\n", i))
+	}
+	p.Write([]byte(lines[0] + lines[1] + lines[2][:3]))
+	p.Write([]byte(lines[2][3:]))
+	for _, line := range lines[3:] {
+		p.Write([]byte(line))
+	}
+
+	if size, root, err := p.Root(); size != 13 || root != treeHash(lines) || err != nil {
+		t.Errorf("Expected [%v, %x, %v] got [%v, %x, %v]", 13, treeHash(lines), nil, size, root, err)
+	}
+
+	for size := int64(1); size <= 13; size++ {
+		root, err := p.RootAt(size)
+		if root != treeHash(lines[:size]) || err != nil {
+			t.Errorf("Expected [%x, %v] got [%x, %v]", treeHash(lines[:size]), nil, root, err)
+		}
+
+		for n := int64(0); n < size; n++ {
+			proof, err := p.InclusionProof(n, size)
+			if err != nil {
+				t.Fatal("Unable to prove inclusion", err)
+			}
+			if err := bufpipe.VerifyInclusion([]byte(lines[n]), n, size, proof, root); err != nil {
+				t.Errorf("Expected line %v in %v lines got %v", n, size, err)
+			}
+			if err := bufpipe.VerifyInclusion([]byte(lines[(n+1)%13]), n, size, proof, root); err != bufpipe.ErrProof {
+				t.Errorf("Expected %v got %v", bufpipe.ErrProof, err)
+			}
+		}
+
+		for old := int64(1); old <= size; old++ {
+			proof, err := p.ConsistencyProof(old, size)
+			if err != nil {
+				t.Fatal("Unable to prove consistency", err)
+			}
+			oldRoot := treeHash(lines[:old])
+			if err := bufpipe.VerifyConsistency(old, size, proof, oldRoot, root); err != nil {
+				t.Errorf("Expected %v lines consistent with %v got %v", old, size, err)
+			}
+			oldRoot[0] ^= 1
+			if err := bufpipe.VerifyConsistency(old, size, proof, oldRoot, root); err != bufpipe.ErrProof {
+				t.Errorf("Expected %v got %v", bufpipe.ErrProof, err)
+			}
+		}
+	}
+
+	if _, err := p.InclusionProof(13, 13); err != bufpipe.ErrTreeSize {
+		t.Errorf("Expected %v got %v", bufpipe.ErrTreeSize, err)
+	}
+	if _, err := p.ConsistencyProof(1, 14); err != bufpipe.ErrTreeSize {
+		t.Errorf("Expected %v got %v", bufpipe.ErrTreeSize, err)
+	}
+}
+
+func TestMerkleTreeAdded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testmerkle")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, index, tree := filepath.Join(dir, "data"), filepath.Join(dir, "index"), filepath.Join(dir, "tree")
+
+	p, err := bufpipe.OpenLineIndexedFilePipe(data, index, 0666)
+	if err != nil {
+		t.Fatal("Unable to create IndexedFile object", err)
+	}
+	p.Write([]byte("one\ntwo\nthree\n"))
+	p.Close()
+
+	p, err = bufpipe.OpenLineIndexedFilePipe(data, index, 0666, bufpipe.WithMerkleTreeFile(tree))
+	if err != nil {
+		t.Fatal("Unable to reopen IndexedFile object", err)
+	}
+
+	// Lines written without the tree are added to it by the next write
+	if size, _, err := p.Root(); size != 0 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 0, nil, size, err)
+	}
+
+	p.Write([]byte("four\nfive\n"))
+	p.Close()
+
+	p, err = bufpipe.OpenLineIndexedFilePipe(data, index, 0666, bufpipe.WithMerkleTreeFile(tree))
+	if err != nil {
+		t.Fatal("Unable to reopen IndexedFile object", err)
+	}
+	defer p.Close()
+
+	lines := []string{"one\n", "two\n", "three\n", "four\n", "five\n"}
+	if size, root, err := p.Root(); size != 5 || root != treeHash(lines) || err != nil {
+		t.Errorf("Expected [%v, %x, %v] got [%v, %x, %v]", 5, treeHash(lines), nil, size, root, err)
+	}
+}
@@ -0,0 +1,23 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package bufpipe
+
+import (
+	"os"
+	"syscall"
+)
+
+const mmapSupported = true
+
+// mmap maps length bytes of f read only, pages past the end of f must not be read
+func mmap(f *os.File, length int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, length, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap(b []byte) error {
+	return syscall.Munmap(b)
+}
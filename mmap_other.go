@@ -0,0 +1,24 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package bufpipe
+
+import (
+	"errors"
+	"os"
+)
+
+const mmapSupported = false
+
+var errMmapUnsupported = errors.New("mmap is not supported on this platform")
+
+func mmap(f *os.File, length int) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func munmap(b []byte) error {
+	return errMmapUnsupported
+}
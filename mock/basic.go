@@ -15,10 +15,11 @@ type ReadWriteSeekable struct {
 	off int64
 
 	// Override default functions
-	ReadFunc  func(rws *ReadWriteSeekable, b []byte) (n int, err error)
-	WriteFunc func(rws *ReadWriteSeekable, b []byte) (n int, err error)
-	SeekFunc  func(rws *ReadWriteSeekable, offset int64, whence int) (int64, error)
-	LenFunc   func(rws *ReadWriteSeekable) int
+	ReadFunc     func(rws *ReadWriteSeekable, b []byte) (n int, err error)
+	WriteFunc    func(rws *ReadWriteSeekable, b []byte) (n int, err error)
+	SeekFunc     func(rws *ReadWriteSeekable, offset int64, whence int) (int64, error)
+	LenFunc      func(rws *ReadWriteSeekable) int
+	TruncateFunc func(rws *ReadWriteSeekable, size int64) error
 }
 
 // NewReadWriteSeekable returns a ReadWriteSeekable with a pre-populated buffer
@@ -117,6 +118,25 @@ func (rws *ReadWriteSeekable) Len() int {
 	return len(rws.buf)
 }
 
+// Truncate discards all but the first size bytes of the buffer, moving the offset back if it
+// was past the new end
+func (rws *ReadWriteSeekable) Truncate(size int64) error {
+	if rws.TruncateFunc != nil {
+		return rws.TruncateFunc(rws, size)
+	}
+
+	if size < 0 {
+		return os.ErrInvalid
+	}
+	if size < int64(len(rws.buf)) {
+		rws.buf = rws.buf[:size]
+	}
+	if rws.off > int64(len(rws.buf)) {
+		rws.off = int64(len(rws.buf))
+	}
+	return nil
+}
+
 // Reset resets the buffer and the offset to 0
 func (rws *ReadWriteSeekable) Reset() {
 	rws.off = 0
@@ -126,6 +146,7 @@ func (rws *ReadWriteSeekable) Reset() {
 	rws.WriteFunc = nil
 	rws.SeekFunc = nil
 	rws.LenFunc = nil
+	rws.TruncateFunc = nil
 }
 
 // Bytes returns the contents of the buffer
@@ -104,6 +104,19 @@ func TestReadWriteSeekable(t *testing.T) {
 		t.Errorf("Expected %v got %v", 82, l)
 	}
 
+	if err := rws.Truncate(12); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if l := rws.Len(); l != 12 {
+		t.Errorf("Expected %v got %v", 12, l)
+	}
+	if s, _ := rws.Seek(0, os.SEEK_CUR); s != 12 {
+		t.Errorf("Expected %v got %v", 12, s)
+	}
+	if err := rws.Truncate(-1); err != os.ErrInvalid {
+		t.Errorf("Expected %v got %v", os.ErrInvalid, err)
+	}
+
 	rws.Reset()
 	s, err := rws.Seek(0, os.SEEK_END)
 	if err != nil {
@@ -128,6 +141,7 @@ func TestReadWriteSeekableOverrides(t *testing.T) {
 	errReadTest := errors.New("read test")
 	errWriteTest := errors.New("write test")
 	errSeekTest := errors.New("seek test")
+	errTruncateTest := errors.New("truncate test")
 
 	p := &mock.ReadWriteSeekable{
 		ReadFunc: func(rws *mock.ReadWriteSeekable, b []byte) (n int, err error) {
@@ -146,6 +160,10 @@ func TestReadWriteSeekableOverrides(t *testing.T) {
 			worked = true
 			return leetLen
 		},
+		TruncateFunc: func(rws *mock.ReadWriteSeekable, size int64) error {
+			worked = true
+			return errTruncateTest
+		},
 	}
 
 	b := make([]byte, 1)
@@ -170,4 +188,9 @@ func TestReadWriteSeekableOverrides(t *testing.T) {
 		t.Errorf("Len test expected [%v, %v] got [%v, %v]", leetLen, true, n, worked)
 	}
 
+	worked = false
+	if err := p.Truncate(leetLen); err != errTruncateTest || !worked {
+		t.Errorf("Truncate test expected [%v, %v] got [%v, %v]", errTruncateTest, true, err, worked)
+	}
+
 }
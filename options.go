@@ -0,0 +1,184 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe
+
+import (
+	"time"
+)
+
+// Option configures a pipe created by one of the Open functions
+type Option func(*options)
+
+// SyncPolicy decides when a pipe syncs its Storages
+type SyncPolicy int
+
+const (
+	// SyncAlways syncs after every write, the default
+	SyncAlways SyncPolicy = iota
+	// SyncNever leaves syncing to the Storage, for files the operating system
+	SyncNever
+)
+
+// Logger is used to report write failures and repairs made when opening a pipe,
+// *log.Logger satisfies it
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+type options struct {
+	sync      SyncPolicy
+	full      FullPolicy
+	limit     int64
+	logger    Logger
+	format    indexHeader // used to initialise an empty index
+	times     Storage
+	timesName string
+	sums      Storage
+	sumsName  string
+	chain     Storage
+	chainName string
+	tree      Storage
+	treeName  string
+	mapped    bool
+	prealloc  int64
+	readOnly  bool
+	follow    bool
+	poll      time.Duration
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		format: newIndexHeader(denseKind),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithSync sets when the pipe syncs its Storages
+func WithSync(policy SyncPolicy) Option {
+	return func(o *options) {
+		o.sync = policy
+	}
+}
+
+// WithLimit limits the data to size bytes, a write that would take the data past it fails with
+// ErrStorageFull without writing anything. A size of 0 is unlimited.
+func WithLimit(size int64) Option {
+	return func(o *options) {
+		o.limit = size
+	}
+}
+
+// WithLogger reports write failures and repairs made when opening a pipe to logger
+func WithLogger(logger Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithDelimiter ends lines with delim rather than '\n'. The delimiter is stored in the index,
+// an existing index keeps the delimiter it was created with.
+func WithDelimiter(delim byte) Option {
+	return func(o *options) {
+		o.format.Delimiter = delim
+	}
+}
+
+// WithSparseIndex only records every so many lines in the index, see NewSparseLineIndexedPipe
+func WithSparseIndex(every IndexInterval) Option {
+	return func(o *options) {
+		o.format.Kind = sparseKind
+		o.format.Every = every
+	}
+}
+
+// WithCompactIndex stores the index in blocks of the given number of lines, see
+// NewCompactLineIndexedPipe. A block of 0 uses DefaultCompactBlock.
+func WithCompactIndex(block int64) Option {
+	return func(o *options) {
+		if block <= 0 {
+			block = DefaultCompactBlock
+		}
+		o.format.Kind = compactKind
+		o.format.Every = IndexInterval{Lines: block}
+	}
+}
+
+// WithTimeIndex records the time each line was written in times, see NewLineTimeIndexedPipe
+func WithTimeIndex(times Storage) Option {
+	return func(o *options) {
+		o.times = times
+	}
+}
+
+// WithTimeIndexFile is WithTimeIndex for OpenLineIndexedFilePipe, recording times in the named
+// file, which is created if required with the same permissions as the data and index.
+func WithTimeIndexFile(name string) Option {
+	return func(o *options) {
+		o.timesName = name
+	}
+}
+
+// WithChecksums records a CRC32C of each line in sums, one little endian uint32 per line. Read
+// and WriteTo verify the lines they return and Verify checks them all, see ChecksumError. ReadAt,
+// View, snapshots and consumers do not. Checksums of lines written without them are added on
+// the next write.
+func WithChecksums(sums Storage) Option {
+	return func(o *options) {
+		o.sums = sums
+	}
+}
+
+// WithChecksumFile is WithChecksums for OpenLineIndexedFilePipe, recording checksums in the named
+// file, which is created if required with the same permissions as the data and index.
+func WithChecksumFile(name string) Option {
+	return func(o *options) {
+		o.sumsName = name
+	}
+}
+
+// WithHashChain records a SHA-256 of each line in chain, hashed over the hash of the line before
+// and the line, so that changing a line breaks the chain from it on, see VerifyChain. Signed
+// checkpoints of the last hash show the lines before it are unchanged, see Checkpoint. Hashes of
+// lines written without them are added on the next write.
+func WithHashChain(chain Storage) Option {
+	return func(o *options) {
+		o.chain = chain
+	}
+}
+
+// WithHashChainFile is WithHashChain for OpenLineIndexedFilePipe, recording hashes in the named
+// file, which is created if required with the same permissions as the data and index.
+func WithHashChainFile(name string) Option {
+	return func(o *options) {
+		o.chainName = name
+	}
+}
+
+// WithMerkleTree keeps an RFC 6962 Merkle tree of the lines in tree, grown as lines are written,
+// for proofs that a line is in the pipe and that the pipe has only been appended to, see Root,
+// InclusionProof and ConsistencyProof. Lines written without it are added on the next write.
+func WithMerkleTree(tree Storage) Option {
+	return func(o *options) {
+		o.tree = tree
+	}
+}
+
+// WithMerkleTreeFile is WithMerkleTree for OpenLineIndexedFilePipe, keeping the tree in the named
+// file, which is created if required with the same permissions as the data and index.
+func WithMerkleTreeFile(name string) Option {
+	return func(o *options) {
+		o.treeName = name
+	}
+}
+
+// WithMemoryMap serves lookups from a memory mapping of the index, see
+// NewMappedLineIndexedFilePipe. It only applies to indexes stored in files.
+func WithMemoryMap() Option {
+	return func(o *options) {
+		o.mapped = true
+	}
+}
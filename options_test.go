@@ -0,0 +1,213 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Ladbrokes/bufpipe"
+	"github.com/Ladbrokes/bufpipe/mock"
+)
+
+func TestOpenPipe(t *testing.T) {
+	unseekable := &mock.ReadWriteSeekable{SeekFunc: unseekableFunc}
+
+	if p, err := bufpipe.OpenPipe(unseekable); p != nil || !errors.Is(err, errUnseekable) {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", nil, errUnseekable, p, err)
+	}
+	if p, err := bufpipe.OpenLineIndexedPipe(unseekable, &mock.ReadWriteSeekable{}); p != nil || !errors.Is(err, errUnseekable) {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", nil, errUnseekable, p, err)
+	}
+
+	// The index is read on open
+	if p, err := bufpipe.OpenLineIndexedPipe(&mock.ReadWriteSeekable{}, mock.NewReadWriteSeekable([]byte("BPIX"))); p != nil || !errors.Is(err, bufpipe.ErrIndexFormat) {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", nil, bufpipe.ErrIndexFormat, p, err)
+	}
+
+	// The New functions still panic
+	defer func() {
+		if err, _ := recover().(error); !errors.Is(err, errUnseekable) {
+			t.Errorf("Expected %v got %v", errUnseekable, err)
+		}
+	}()
+	bufpipe.NewPipe(unseekable)
+}
+
+func TestLimitOption(t *testing.T) {
+	p, err := bufpipe.OpenStoragePipe(bufpipe.NewMemoryStorage(), bufpipe.WithLimit(10))
+	if err != nil {
+		t.Fatal("Unable to open pipe", err)
+	}
+
+	p.Write([]byte("12345678"))
+	if n, err := p.Write([]byte("9ABC")); n != 0 || err != bufpipe.ErrStorageFull {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 0, bufpipe.ErrStorageFull, n, err)
+	}
+	if n, err := p.Write([]byte("9A")); n != 2 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 2, nil, n, err)
+	}
+
+	d := make([]byte, 10)
+	if n, err := p.Read(d); n != 10 || err != nil || string(d) != "123456789A" {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", "123456789A", nil, string(d[:n]), err)
+	}
+
+	l, err := bufpipe.OpenLineIndexedStoragePipe(bufpipe.NewMemoryStorage(), bufpipe.NewMemoryStorage(), bufpipe.WithLimit(4))
+	if err != nil {
+		t.Fatal("Unable to open pipe", err)
+	}
+	if n, err := l.Write([]byte("a\nb\nc\n")); n != 0 || err != bufpipe.ErrStorageFull {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 0, bufpipe.ErrStorageFull, n, err)
+	}
+	if n, err := l.CountLines(); n != 0 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 0, nil, n, err)
+	}
+}
+
+func TestDelimiterOption(t *testing.T) {
+	data := &mock.ReadWriteSeekable{}
+	index := &mock.ReadWriteSeekable{}
+
+	p, err := bufpipe.OpenLineIndexedPipe(data, index, bufpipe.WithDelimiter(0))
+	if err != nil {
+		t.Fatal("Unable to open pipe", err)
+	}
+	p.Write([]byte("one\x00two\nstill two\x00three"))
+
+	if n, err := p.CountLines(); n != 2 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 2, nil, n, err)
+	}
+
+	// The index keeps the delimiter it was created with
+	if p, err = bufpipe.OpenLineIndexedPipe(data, index, bufpipe.WithDelimiter(';')); err != nil {
+		t.Fatal("Unable to open pipe", err)
+	}
+	p.Write([]byte("\x00"))
+
+	if n, err := p.CountLines(); n != 3 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 3, nil, n, err)
+	}
+
+	p.SeekLine(1)
+	d := make([]byte, 14)
+	if n, err := p.Read(d); n != 14 || err != nil || string(d) != "two\nstill two\x00" {
+		t.Errorf("Expected [%q, %v] got [%q, %v]", "two\nstill two\x00", nil, d[:n], err)
+	}
+}
+
+func TestLoggerOption(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(&buf, "", 0)
+
+	// Lines missing from the index are logged as they are repaired
+	data := mock.NewReadWriteSeekable([]byte("a\nb\nc\n"))
+	if _, err := bufpipe.OpenLineIndexedPipe(data, &mock.ReadWriteSeekable{}, bufpipe.WithLogger(logger)); err != nil {
+		t.Fatal("Unable to open pipe", err)
+	}
+	if expect := "bufpipe: added 3 lines missing from the index\n"; buf.String() != expect {
+		t.Errorf("Expected %q got %q", expect, buf.String())
+	}
+
+	buf.Reset()
+	p, _ := bufpipe.OpenPipe(&mock.ReadWriteSeekable{WriteFunc: unwriteableFunc}, bufpipe.WithLogger(logger))
+	_, werr := p.Write([]byte("a"))
+	p.Write([]byte("a"))
+	if expect := "bufpipe: write failed, closing pipe: " + werr.Error() + "\n"; buf.String() != expect {
+		t.Errorf("Expected %q got %q", expect, buf.String())
+	}
+}
+
+type syncCounter struct {
+	*bufpipe.MemoryStorage
+	syncs int
+}
+
+func (s *syncCounter) Sync() error {
+	s.syncs++
+	return nil
+}
+
+func TestSyncOption(t *testing.T) {
+	for _, test := range []struct {
+		opts   []bufpipe.Option
+		expect int
+	}{
+		{nil, 3},
+		{[]bufpipe.Option{bufpipe.WithSync(bufpipe.SyncAlways)}, 3},
+		{[]bufpipe.Option{bufpipe.WithSync(bufpipe.SyncNever)}, 0},
+	} {
+		data := &syncCounter{MemoryStorage: bufpipe.NewMemoryStorage()}
+		index := &syncCounter{MemoryStorage: bufpipe.NewMemoryStorage()}
+
+		p, err := bufpipe.OpenStoragePipe(data, test.opts...)
+		if err != nil {
+			t.Fatal("Unable to open pipe", err)
+		}
+		p.Write([]byte("a\n"))
+		p.Write([]byte("b\n"))
+		p.Write([]byte("c\n"))
+		if data.syncs != test.expect {
+			t.Errorf("Expected %v got %v", test.expect, data.syncs)
+		}
+
+		// The index is synced on creation and for each line
+		l, err := bufpipe.OpenLineIndexedStoragePipe(bufpipe.NewMemoryStorage(), index, test.opts...)
+		if err != nil {
+			t.Fatal("Unable to open pipe", err)
+		}
+		l.Write([]byte("a\nb\n"))
+		if index.syncs != test.expect {
+			t.Errorf("Expected %v got %v", test.expect, index.syncs)
+		}
+	}
+}
+
+func TestOpenLineIndexedFilePipe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testopen")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := filepath.Join(dir, "data")
+	index := filepath.Join(dir, "index")
+	times := filepath.Join(dir, "times")
+
+	p, err := bufpipe.OpenLineIndexedFilePipe(data, index, 0666,
+		bufpipe.WithSparseIndex(bufpipe.IndexInterval{Lines: 10}),
+		bufpipe.WithTimeIndexFile(times),
+	)
+	if err != nil {
+		t.Fatal("Unable to open pipe", err)
+	}
+	writeNumberedLines(t, p, 0, 25)
+	testSeekLines(t, p.LineIndexedPipe, 25)
+
+	if first, last, err := p.LinesBetween(time.Time{}, time.Now().Add(time.Hour)); first != 0 || last != 25 || err != nil {
+		t.Errorf("Expected [%v, %v, %v] got [%v, %v, %v]", 0, 25, nil, first, last, err)
+	}
+
+	// Sparse, 3 checkpoints
+	if n, err := p.IndexSize(); n != 32+3*16 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 32+3*16, nil, n, err)
+	}
+	p.Close()
+
+	// A failed open closes the files it opened
+	if p, err = bufpipe.OpenLineIndexedFilePipe(data, index, 0666, bufpipe.WithTimeIndexFile(dir)); p != nil || err == nil {
+		t.Errorf("Expected [%v, error] got [%v, %v]", nil, p, err)
+	}
+
+	ioutil.WriteFile(index, []byte("BPIX"), 0666)
+	if p, err = bufpipe.OpenLineIndexedFilePipe(data, index, 0666); p != nil || !errors.Is(err, bufpipe.ErrIndexFormat) {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", nil, bufpipe.ErrIndexFormat, p, err)
+	}
+}
@@ -10,127 +10,240 @@ import (
 	"sync"
 )
 
-// Pipe provides a ReadWriter interface to store data in a ReadWriteSeeker
+// Pipe provides a ReadWriter interface to store data in a Storage
+//
+// Reads are made at their position in the Storage without holding the pipe lock, so readers
+// do not wait on each other or on writers doing I/O.
 type Pipe struct {
-	data io.ReadWriteSeeker
+	data     Storage
+	release  Releaser // set if data can discard what has been read
+	sync     SyncPolicy
+	full     FullPolicy
+	limit    int64
+	logger   Logger
+	readOnly bool // written by another process
+
+	boundary func(offset int64) (int64, error) // where readers can be moved to at or after offset
+
+	wl sync.Mutex // serialises writers, held for the whole of a write
 
 	readIndex int64
 	size      int64
+	reading   int // reads in progress
 
 	l sync.Mutex // protects remaining fields
 
 	rwait sync.Cond // waiting reader
 
-	rerr error // if reader closed, error to give writes
-	werr error // if writer closed, error to give reads
+	rerr     error // if reader closed, error to give writes
+	werr     error // if writer closed, error to give reads
+	closed   bool  // closed by Close, errors can not be recovered from
+	dropping bool  // a writer waits for reads to finish to drop data
+
+	done chan struct{} // closed by Close
 
 }
 
 // ErrBadSeekOffset is returned when seek doesn't end up at the expected location
 var ErrBadSeekOffset = errors.New("seek offset failure")
 
+// ErrNegativeOffset is returned by ReadAt when reading from before the start of the data
+var ErrNegativeOffset = errors.New("negative offset")
+
 // Syncer interface lists pipe optionally sync changes
 type Syncer interface {
 	Sync() error
 }
 
-// NewPipe returns a new line indexed pipe structure
+// NewPipe returns a new pipe structure around data, see NewStorage
 func NewPipe(data io.ReadWriteSeeker) *Pipe {
-	size, err := data.Seek(0, os.SEEK_END)
+	return NewStoragePipe(NewStorage(data))
+}
+
+// NewStoragePipe returns a new pipe structure around data, it panics if the size of data
+// can not be found, see OpenStoragePipe
+func NewStoragePipe(data Storage) *Pipe {
+	l, err := OpenStoragePipe(data)
 	if err != nil {
 		panic(err)
 	}
+	return l
+}
+
+// OpenPipe returns a new pipe structure around data configured by opts, see NewStorage
+func OpenPipe(data io.ReadWriteSeeker, opts ...Option) (*Pipe, error) {
+	return OpenStoragePipe(NewStorage(data), opts...)
+}
+
+// OpenStoragePipe returns a new pipe structure around data configured by opts
+func OpenStoragePipe(data Storage, opts ...Option) (*Pipe, error) {
+	return openPipe(data, newOptions(opts))
+}
+
+func openPipe(data Storage, o *options) (*Pipe, error) {
+	if o.readOnly {
+		data = newReadOnlyStorage(data)
+	}
+
+	size, err := data.Size()
+	if err != nil {
+		return nil, pipeError("size", "data", err)
+	}
 
 	l := &Pipe{
-		data: data,
-		size: size,
+		data:     data,
+		size:     size,
+		sync:     o.sync,
+		full:     o.full,
+		limit:    o.limit,
+		logger:   o.logger,
+		readOnly: o.readOnly,
+		done:     make(chan struct{}),
 	}
+	l.release, _ = data.(Releaser)
 
 	l.rwait.L = &l.l
-	return l
+	return l, nil
 }
 
 // Read implements the standard Read interface: it reads data from the pipe, blocking
 // until a writer arrives or the write end is closed. If the write end is closed with
 // an error, that error is returned as err; otherwise err is EOF.
 func (l *Pipe) Read(d []byte) (n int, err error) {
-	n, err = func() (n int, err error) {
-		l.l.Lock()
-		defer l.l.Unlock()
+	_, n, err = l.read(d)
+	return
+}
 
-		for {
-			if l.rerr != nil {
-				return 0, io.ErrClosedPipe
-			}
-			if l.werr != nil {
-				return 0, l.werr
-			}
-			if l.readIndex < l.size {
-				break
-			}
-			l.rwait.Wait()
-		}
+// read is Read returning the offset the data was read from. What could not be read is left to
+// be read again once the pipe is recovered, unless another reader has claimed what follows it.
+func (l *Pipe) read(d []byte) (offset int64, n int, err error) {
+	offset, length, err := l.claim(int64(len(d)))
+	if err != nil {
+		return 0, 0, err
+	}
+	n, err = l.readData(d[:length], offset)
+	if err != nil {
+		l.unclaim(offset+int64(n), offset+length)
+	}
+	l.finish(err)
+	return
+}
 
-		if _, err = l.data.Seek(l.readIndex, os.SEEK_SET); err != nil {
-			return
+// claim waits for data and claims up to max bytes of it from offset, so concurrent readers get
+// the data that follows it. Every successful claim must be followed by a call to finish.
+func (l *Pipe) claim(max int64) (offset, length int64, err error) {
+	l.l.Lock()
+	defer l.l.Unlock()
+
+	for {
+		if l.rerr != nil {
+			return 0, 0, io.ErrClosedPipe
+		}
+		if l.werr != nil {
+			l.rerr = l.werr
+			return 0, 0, l.werr
 		}
+		if l.readIndex < l.size {
+			break
+		}
+		l.rwait.Wait()
+	}
 
-		n, err = l.data.Read(d)
-		l.readIndex += int64(n)
-		return
-	}()
+	offset = l.readIndex
+	if length = l.size - offset; length > max {
+		length = max
+	}
+	l.readIndex += length
+	l.reading++
+	return
+}
+
+// unclaim returns the unread part of a claimed range, from offset to end, to be read again if no
+// other reader has claimed what follows it. It must be called before finish releases the range.
+func (l *Pipe) unclaim(offset, end int64) {
+	l.l.Lock()
+	defer l.l.Unlock()
+
+	if l.readIndex == end {
+		l.readIndex = offset
+	}
+}
+
+// finish ends a read of a claimed range, stopping the read end if it failed with err
+func (l *Pipe) finish(err error) {
+	l.l.Lock()
+	defer l.l.Unlock()
+
+	if l.reading--; l.reading == 0 {
+		if l.release != nil {
+			l.release.Release(l.readIndex)
+		}
+		if l.dropping {
+			l.rwait.Broadcast()
+		}
+	}
 	if err != nil {
 		l.rerr = err
 	}
-	return
 }
 
 // Write implements the standard Write interface: it writes data to the pipe, blocking
 // until readers have consumed all the data or the read end is closed. If the read end
 // is closed with an error, that err is returned as err; otherwise err is ErrClosedPipe.
 func (l *Pipe) Write(d []byte) (n int, err error) {
-	n, err = func() (n int, err error) {
-		l.l.Lock()
-		defer l.l.Unlock()
-
-		if l.rerr != nil {
-			err = l.rerr
-			return
-		}
-		if l.werr != nil {
-			err = io.ErrClosedPipe
-			return
-		}
+	if l.readOnly {
+		return 0, ErrReadOnly
+	}
 
-		if _, err = l.data.Seek(0, os.SEEK_END); err != nil {
-			return
-		}
+	l.wl.Lock()
+	defer l.wl.Unlock()
 
-		n, err = l.data.Write(d)
+	if err = l.fits(len(d)); err != nil {
+		return
+	}
 
-		if err == nil {
-			err = l.syncWriter(l.data)
+	n, err = func() (n int, err error) {
+		if err = l.writable(); err != nil {
+			return
 		}
 
-		l.size += int64(n)
-		l.rwait.Signal()
+		err = l.retryFull(len(d), func() (err error) {
+			if n, err = l.data.Append(d); err != nil {
+				return pipeError("write", "data", err)
+			}
+			return pipeError("sync", "data", l.syncData(l.data))
+		}, func() error {
+			n = 0
+			return pipeError("truncate", "data", l.data.Truncate(l.size))
+		})
 
 		return
 	}()
-	if err != nil {
+
+	l.l.Lock()
+	defer l.l.Unlock()
+
+	l.size += int64(n)
+	if l.stops(err) {
+		if l.werr == nil {
+			l.logf("bufpipe: write failed, closing pipe: %v", err)
+		}
 		l.werr = err
 	}
+	l.rwait.Broadcast()
+
 	return
 }
 
-// Seek sets the offset for the next Read to offset, the Write offset is always the end of the data.
+// Seek sets the offset for the next Read to offset, interpreted according to whence as os.File
+// does but kept within the data. The Write offset is always the end of the data.
 func (l *Pipe) Seek(offset int64, whence int) (int64, error) {
 	l.l.Lock()
 	defer l.l.Unlock()
 
 	switch whence {
 	case os.SEEK_END:
-		l.readIndex = l.size - offset
+		l.readIndex = l.size + offset
 	case os.SEEK_SET:
 		l.readIndex = offset
 	case os.SEEK_CUR:
@@ -155,17 +268,124 @@ func (l *Pipe) DataSize() (int64, error) {
 	return l.size, nil
 }
 
-func (l *Pipe) close() {
+// Close closes the pipe and then its Storage once any write in progress finishes, rendering
+// the pipe unusable for I/O. It returns the error closing the Storage, if any.
+func (l *Pipe) Close() error {
+	l.close()
+
+	l.wl.Lock()
+	defer l.wl.Unlock()
+
+	return pipeError("close", "data", l.data.Close())
+}
+
+// Recover clears the error that stopped the pipe, such as a temporary failure of its Storage,
+// once the size of the data has been read again. Data a failed write left in the Storage is
+// kept. Recover returns io.ErrClosedPipe if the pipe was closed by Close.
+func (l *Pipe) Recover() (err error) {
+	l.wl.Lock()
+	defer l.wl.Unlock()
+
+	if err = l.resize(); err != nil {
+		return
+	}
+
+	return l.clearError()
+}
+
+// resize takes the size of the data from the Storage, the caller must hold wl
+func (l *Pipe) resize() error {
+	size, err := l.data.Size()
+
 	l.l.Lock()
 	defer l.l.Unlock()
-	l.rerr = io.ErrClosedPipe
-	l.werr = io.ErrClosedPipe
-	l.rwait.Signal()
+
+	if l.closed {
+		return io.ErrClosedPipe
+	}
+	if err != nil {
+		return pipeError("size", "data", err)
+	}
+
+	l.size = size
+	if l.readIndex > size {
+		l.readIndex = size
+	}
+
+	return nil
 }
 
-func (l *Pipe) syncWriter(w io.Writer) error {
-	if t, ok := w.(Syncer); ok {
-		return t.Sync()
+// clearError clears rerr and werr unless the pipe was closed by Close
+func (l *Pipe) clearError() error {
+	l.l.Lock()
+	defer l.l.Unlock()
+
+	if l.closed {
+		return io.ErrClosedPipe
+	}
+
+	l.rerr, l.werr = nil, nil
+	l.rwait.Broadcast()
+
+	return nil
+}
+
+// writable returns the error a write should fail with, if any
+func (l *Pipe) writable() error {
+	l.l.Lock()
+	defer l.l.Unlock()
+
+	if l.rerr != nil {
+		return l.rerr
+	}
+	if l.werr != nil {
+		return io.ErrClosedPipe
 	}
 	return nil
 }
+
+// fits returns ErrStorageFull if writing n bytes would take the data past the limit, the
+// caller must hold wl
+func (l *Pipe) fits(n int) error {
+	if l.limit > 0 && l.size+int64(n) > l.limit {
+		return ErrStorageFull
+	}
+	return nil
+}
+
+// syncData syncs s unless the sync policy leaves it to the Storage
+func (l *Pipe) syncData(s Storage) error {
+	if l.sync == SyncNever {
+		return nil
+	}
+	return s.Sync()
+}
+
+func (l *Pipe) logf(format string, v ...interface{}) {
+	if l.logger != nil {
+		l.logger.Printf(format, v...)
+	}
+}
+
+// readData reads len(p) bytes of data from offset
+func (l *Pipe) readData(p []byte, offset int64) (n int, err error) {
+	n, err = l.data.ReadAt(p, offset)
+	if n == len(p) {
+		err = nil
+	} else {
+		err = pipeError("read", "data", err)
+	}
+	return
+}
+
+func (l *Pipe) close() {
+	l.l.Lock()
+	defer l.l.Unlock()
+	l.rerr = io.ErrClosedPipe
+	l.werr = io.ErrClosedPipe
+	if !l.closed {
+		close(l.done)
+	}
+	l.closed = true
+	l.rwait.Broadcast()
+}
@@ -5,6 +5,9 @@ package bufpipe
 
 import (
 	"io"
+	"io/ioutil"
+	"os"
+	"sync"
 	"testing"
 
 	"github.com/Ladbrokes/bufpipe/mock"
@@ -23,3 +26,60 @@ func TestClosedPipe(t *testing.T) {
 		t.Errorf("Writing a closed pipe. Expected [%v, %v] got [%v, %v]", 0, io.ErrClosedPipe, n, err)
 	}
 }
+
+func TestConcurrentReadersPipe(t *testing.T) {
+	f, err := ioutil.TempFile("", "testconcurrent")
+	if err != nil {
+		t.Fatal("Unable to create temporary data file", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	p := NewPipe(f)
+
+	expect := make([]byte, 4096)
+	for i := range expect {
+		expect[i] = byte(i)
+	}
+	p.Write(expect)
+
+	// Every byte is read exactly once between the readers
+	var mu sync.Mutex
+	seen := make([]int, len(expect))
+	total := 0
+
+	var wg sync.WaitGroup
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d := make([]byte, 7)
+			for {
+				n, err := p.Read(d)
+				if err != nil {
+					return
+				}
+
+				mu.Lock()
+				for i := 0; i < n; i++ {
+					seen[d[i]]++
+				}
+				total += n
+				if total == len(expect) {
+					p.close()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if total != len(expect) {
+		t.Errorf("Expected %v got %v", len(expect), total)
+	}
+	for i, c := range seen[:256] {
+		if c != len(expect)/256 {
+			t.Errorf("Byte %d read %d times", i, c)
+		}
+	}
+}
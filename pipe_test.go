@@ -35,8 +35,8 @@ func TestNewPipe(t *testing.T) {
 
 func TestNewPipePanic(t *testing.T) {
 	defer func() {
-		err := recover()
-		if err != errUnseekable {
+		err, _ := recover().(error)
+		if !errors.Is(err, errUnseekable) {
 			t.Errorf("Expected %v got %v", errUnseekable, err)
 		}
 	}()
@@ -128,7 +128,7 @@ func TestReadSeekWriteReadPipe(t *testing.T) {
 		t.Errorf("Expected %v got %v", expect, d[:n])
 	}
 
-	for _, test := range [][]int{{22, os.SEEK_SET, 13}, {22, os.SEEK_END, 0}, {5, os.SEEK_CUR, 5}} {
+	for _, test := range [][]int{{22, os.SEEK_SET, 13}, {22, os.SEEK_END, 13}, {-3, os.SEEK_END, 10}, {-5, os.SEEK_CUR, 5}, {-22, os.SEEK_END, 0}} {
 		if n, err := p.Seek(int64(test[0]), test[1]); n != int64(test[2]) || err != nil {
 			t.Errorf("Expected [%v, %v] got [%v, %v]", test[2], nil, n, err)
 		}
@@ -140,7 +140,7 @@ func TestLateSeekFailWritePipe(t *testing.T) {
 	buf := mock.NewReadWriteSeekable([]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9})
 	p := bufpipe.NewPipe(buf)
 	buf.SeekFunc = unseekableFunc
-	if n, err := p.Write([]byte{1}); n != 0 || err != errUnseekable {
+	if n, err := p.Write([]byte{1}); n != 0 || !errors.Is(err, errUnseekable) {
 		t.Errorf("Expected [%v, %v] got [%v, %v]", 0, errUnseekable, n, err)
 	}
 
@@ -155,7 +155,7 @@ func TestLateSeekFailReadPipe(t *testing.T) {
 	p := bufpipe.NewPipe(buf)
 	buf.SeekFunc = unseekableFunc
 	d := make([]byte, 1)
-	if n, err := p.Read(d); n != 0 || err != errUnseekable {
+	if n, err := p.Read(d); n != 0 || !errors.Is(err, errUnseekable) {
 		t.Errorf("Expected [%v, %v] got [%v, %v]", 0, errUnseekable, n, err)
 	}
 
@@ -180,3 +180,59 @@ func TestSyncPipe(t *testing.T) {
 		t.Errorf("Sync did not get called")
 	}
 }
+
+// blockingReaderAt is a positional backend whose reads wait to be released
+type blockingReaderAt struct {
+	*mock.ReadWriteSeekable
+	initial []byte
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	close(b.reading)
+	<-b.release
+	return copy(p, b.initial[off:]), nil
+}
+
+func TestWriteDuringReadPipe(t *testing.T) {
+	initial := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	data := &blockingReaderAt{
+		ReadWriteSeekable: mock.NewReadWriteSeekable(append([]byte{}, initial...)),
+		initial:           initial,
+		reading:           make(chan struct{}),
+		release:           make(chan struct{}),
+	}
+	p := bufpipe.NewPipe(data)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d := make([]byte, 10)
+		if n, err := p.Read(d); err != nil || n != 10 || !bytes.Equal(initial, d) {
+			t.Errorf("Expected [%v, %v, %v] got [%v, %v, %v]", 10, nil, initial, n, err, d)
+		}
+	}()
+
+	<-data.reading
+
+	// The read in progress does not hold up the writer
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		p.Write([]byte{10, 11})
+	}()
+
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Error("Write blocked by a read in progress")
+	}
+
+	close(data.release)
+	<-done
+
+	if s, err := p.DataSize(); err != nil || s != 12 {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", nil, 12, err, s)
+	}
+}
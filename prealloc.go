@@ -0,0 +1,281 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// ErrPreallocateDelimiter is returned when preallocating the files of a pipe whose lines end
+// with 0, which can not be told apart from unused preallocated space
+var ErrPreallocateDelimiter = errors.New("preallocation needs a delimiter other than 0")
+
+// indexDirty is set in the flags of the index header while a preallocated pipe is open, the files
+// may then have unused preallocated space at their ends
+const indexDirty = 1
+
+// WithPreallocate has OpenLineIndexedFilePipe grow the data and index files size bytes at a time
+// ahead of what has been written, on Linux with fallocate, so appending does not change the size
+// of the files. The files are cut back to what has been written by Close.
+//
+// The index records that the files are open. If they are not closed cleanly, trailing zero bytes
+// in the index are taken to be unused and the data is cut back after the last line in the index
+// and any partial line following it, less trailing zero bytes. Legacy indexes must be migrated
+// first, see MigrateIndexFile. Pipes opened read only, or following the files, leave
+// out the trailing zero bytes of both files while the index records they are open.
+func WithPreallocate(size int64) Option {
+	return func(o *options) {
+		o.prealloc = size
+	}
+}
+
+// preallocStorage is Storage on an os.File that is grown in chunks ahead of the data appended
+// to it, tracking the size of the data separately from that of the file
+type preallocStorage struct {
+	f     *os.File
+	chunk int64
+
+	mu        sync.RWMutex // protects remaining fields
+	size      int64        // size of the data
+	allocated int64        // size of the file
+
+	closing func(f *os.File) error // optional, called by Close once the file is cut back
+}
+
+func newPreallocStorage(f *os.File, chunk int64) (*preallocStorage, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &preallocStorage{
+		f:         f,
+		chunk:     chunk,
+		size:      info.Size(),
+		allocated: info.Size(),
+	}, nil
+}
+
+func (s *preallocStorage) file() *os.File {
+	return s.f
+}
+
+func (s *preallocStorage) ReadAt(p []byte, off int64) (n int, err error) {
+	s.mu.RLock()
+	size := s.size
+	s.mu.RUnlock()
+
+	if off >= size {
+		return 0, io.EOF
+	}
+
+	d := p
+	if remaining := size - off; int64(len(d)) > remaining {
+		d = d[:remaining]
+	}
+	if n, err = s.f.ReadAt(d, off); err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+func (s *preallocStorage) Append(p []byte) (n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if end := s.size + int64(len(p)); end > s.allocated {
+		// Without preallocation writing still grows the file
+		end = (end + s.chunk - 1) / s.chunk * s.chunk
+		if fallocate(s.f, s.allocated, end-s.allocated) == nil {
+			s.allocated = end
+		}
+	}
+
+	n, err = s.f.WriteAt(p, s.size)
+	if s.size += int64(n); s.size > s.allocated {
+		s.allocated = s.size
+	}
+	return
+}
+
+func (s *preallocStorage) Size() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.size, nil
+}
+
+// Truncate cuts the file back to size, dropping the preallocated space so that what was written
+// past size can not be mistaken for data
+func (s *preallocStorage) Truncate(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if size > s.size {
+		return nil
+	}
+	if err := s.f.Truncate(size); err != nil {
+		return err
+	}
+	s.size, s.allocated = size, size
+	return nil
+}
+
+func (s *preallocStorage) Sync() error {
+	return s.f.Sync()
+}
+
+// Close cuts the file back to the size of the data before closing it
+func (s *preallocStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.f.Truncate(s.size)
+	if err == nil && s.closing != nil {
+		err = s.closing(s.f)
+	}
+	return errors.Join(err, s.f.Close())
+}
+
+// setSize sets the size of the data recovered after the file was not closed cleanly
+func (s *preallocStorage) setSize(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.size = size
+}
+
+// trimZeros returns the size of the data in s from start, less trailing zero bytes
+func trimZeros(s Storage, start int64) (size int64, err error) {
+	if size, err = s.Size(); err != nil {
+		return
+	}
+
+	buf := make([]byte, 32*1024)
+	for size > start {
+		from := size - int64(len(buf))
+		if from < start {
+			from = start
+		}
+
+		d := buf[:size-from]
+		if _, err = s.ReadAt(d, from); err != nil {
+			return
+		}
+		for i := len(d) - 1; i >= 0; i-- {
+			if d[i] != 0 {
+				return from + int64(i) + 1, nil
+			}
+		}
+		size = from
+	}
+
+	return
+}
+
+// preallocatedFile is a data or index file opened read only that another process may be writing
+// using WithPreallocate. While the index records that the writer has the files open, trailing
+// zero bytes after start are unused space and left out of the size.
+type preallocatedFile struct {
+	Storage
+	f     *os.File
+	index *os.File
+	start int64
+}
+
+func newPreallocatedFile(f, index *os.File, start int64) *preallocatedFile {
+	return &preallocatedFile{Storage: NewFileStorage(f), f: f, index: index, start: start}
+}
+
+func (s *preallocatedFile) file() *os.File {
+	return s.f
+}
+
+// Size implements the Storage interface, leaving out unused preallocated space
+func (s *preallocatedFile) Size() (int64, error) {
+	h := make([]byte, indexFlagsOffset+1)
+	if _, err := s.index.ReadAt(h, 0); err == io.EOF {
+		return s.Storage.Size()
+	} else if err != nil {
+		return 0, err
+	}
+	if string(h[:len(indexMagic)]) != indexMagic || h[indexFlagsOffset]&indexDirty == 0 {
+		return s.Storage.Size()
+	}
+
+	return trimZeros(s.Storage, s.start)
+}
+
+// preallocate wraps the data and index files in preallocStorage, returning whether they were
+// left with unused preallocated space by not being closed cleanly
+func preallocate(dataFile, indexFile *os.File, o *options) (data, index *preallocStorage, dirty bool, err error) {
+	if data, err = newPreallocStorage(dataFile, o.prealloc); err != nil {
+		return
+	}
+	if index, err = newPreallocStorage(indexFile, o.prealloc); err != nil {
+		return
+	}
+
+	delim := o.format.Delimiter
+	if index.size > 0 {
+		var h indexHeader
+		if h, err = readIndexHeader(index, index.size); err != nil {
+			if err == errLegacyIndex {
+				err = ErrIndexFormat
+			}
+			return
+		}
+
+		if dirty = h.Flags&indexDirty != 0; dirty {
+			var size int64
+			if size, err = trimZeros(index, indexHeaderSize); err != nil {
+				return
+			}
+			index.setSize(size)
+		}
+		delim = h.Delimiter
+	}
+
+	if delim == 0 {
+		err = ErrPreallocateDelimiter
+	}
+
+	return
+}
+
+// openPreallocated cuts the data back after the last line in the index, and any partial line
+// following it, if the files were not closed cleanly. It then records in the index that the
+// files are open until Close. The caller must hold wl or be the only user of the pipe.
+func (l *LineIndexedPipe) openPreallocated(data, index *preallocStorage, dirty bool) error {
+	if dirty {
+		size, err := trimZeros(data, l.lastIndex)
+		if err != nil {
+			return pipeError("load", "data", err)
+		}
+		data.setSize(size)
+
+		l.l.Lock()
+		l.size = size
+		l.l.Unlock()
+	}
+
+	if err := setIndexFlags(index.f, indexDirty); err != nil {
+		return pipeError("write", "index", err)
+	}
+	index.closing = func(f *os.File) error {
+		return setIndexFlags(f, 0)
+	}
+
+	return nil
+}
+
+// setIndexFlags writes the flags of the index header
+func setIndexFlags(f *os.File, flags uint8) error {
+	if _, err := f.WriteAt([]byte{flags}, indexFlagsOffset); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,17 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package bufpipe
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocate allocates length bytes of f from off, growing the file if needed
+func fallocate(f *os.File, off, length int64) error {
+	return syscall.Fallocate(int(f.Fd()), 0, off, length)
+}
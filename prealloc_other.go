@@ -0,0 +1,18 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package bufpipe
+
+import (
+	"errors"
+	"os"
+)
+
+var errFallocateUnsupported = errors.New("fallocate is not supported on this platform")
+
+func fallocate(f *os.File, off, length int64) error {
+	return errFallocateUnsupported
+}
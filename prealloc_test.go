@@ -0,0 +1,195 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/Ladbrokes/bufpipe"
+)
+
+func fileSize(t *testing.T, name string) int64 {
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal("Unable to stat", err)
+	}
+	return info.Size()
+}
+
+func TestPreallocateLineIndexedFilePipe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testprealloc")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := filepath.Join(dir, "data")
+	index := filepath.Join(dir, "index")
+
+	p, err := bufpipe.OpenLineIndexedFilePipe(data, index, 0666, bufpipe.WithPreallocate(4096))
+	if err != nil {
+		t.Fatal("Unable to open pipe", err)
+	}
+	writeNumberedLines(t, p, 0, 20)
+
+	if runtime.GOOS == "linux" {
+		if n := fileSize(t, data); n != 4096 {
+			t.Errorf("Expected %v got %v", 4096, n)
+		}
+	}
+	size, _ := p.DataSize()
+	testSeekLines(t, p.LineIndexedPipe, 20)
+
+	// Close cuts the files back
+	if err := p.Close(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if n := fileSize(t, data); n != size {
+		t.Errorf("Expected %v got %v", size, n)
+	}
+	if n := fileSize(t, index); n != 32+20*8 {
+		t.Errorf("Expected %v got %v", 32+20*8, n)
+	}
+
+	// And can be opened as normal
+	if p, err = bufpipe.OpenLineIndexedFilePipe(data, index, 0666); err != nil {
+		t.Fatal("Unable to open pipe", err)
+	}
+	testSeekLines(t, p.LineIndexedPipe, 20)
+	p.Close()
+}
+
+func TestPreallocateRecoverLineIndexedFilePipe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testprealloc")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := filepath.Join(dir, "data")
+	index := filepath.Join(dir, "index")
+
+	p, err := bufpipe.OpenLineIndexedFilePipe(data, index, 0666, bufpipe.WithPreallocate(4096))
+	if err != nil {
+		t.Fatal("Unable to open pipe", err)
+	}
+	writeNumberedLines(t, p, 0, 20)
+	p.Write([]byte("partial"))
+	size, _ := p.DataSize()
+
+	// Copy the files as they would be found after a crash
+	for _, name := range []string{data, index} {
+		b, _ := ioutil.ReadFile(name)
+		ioutil.WriteFile(name+".crash", b, 0666)
+	}
+	p.Close()
+
+	if runtime.GOOS == "linux" {
+		if n := fileSize(t, data+".crash"); n != 4096 {
+			t.Errorf("Expected %v got %v", 4096, n)
+		}
+	}
+
+	if p, err = bufpipe.OpenLineIndexedFilePipe(data+".crash", index+".crash", 0666, bufpipe.WithPreallocate(4096)); err != nil {
+		t.Fatal("Unable to open pipe", err)
+	}
+	if n, err := p.DataSize(); n != size || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", size, nil, n, err)
+	}
+	if n, err := p.CountLines(); n != 20 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 20, nil, n, err)
+	}
+
+	p.Write([]byte(" line\n"))
+	p.SeekLine(20)
+	d := make([]byte, 13)
+	if n, err := io.ReadFull(p, d); n != 13 || err != nil || string(d) != "partial line\n" {
+		t.Errorf("Expected [%q, %v] got [%q, %v]", "partial line\n", nil, d[:n], err)
+	}
+	testSeekLines(t, p.LineIndexedPipe, 20)
+	p.Close()
+
+	if n := fileSize(t, index+".crash"); n != 32+21*8 {
+		t.Errorf("Expected %v got %v", 32+21*8, n)
+	}
+}
+
+func TestPreallocateUnsupportedIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testprealloc")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := filepath.Join(dir, "data")
+	index := filepath.Join(dir, "index")
+
+	_, err = bufpipe.OpenLineIndexedFilePipe(data, index, 0666, bufpipe.WithPreallocate(4096), bufpipe.WithDelimiter(0))
+	if !errors.Is(err, bufpipe.ErrPreallocateDelimiter) {
+		t.Errorf("Expected %v got %v", bufpipe.ErrPreallocateDelimiter, err)
+	}
+
+	ioutil.WriteFile(index, legacyIndex, 0666)
+	_, err = bufpipe.OpenLineIndexedFilePipe(data, index, 0666, bufpipe.WithPreallocate(4096))
+	if !errors.Is(err, bufpipe.ErrIndexFormat) {
+		t.Errorf("Expected %v got %v", bufpipe.ErrIndexFormat, err)
+	}
+}
+
+func TestPreallocateReadOnlyLineIndexedFilePipe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testprealloc")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := filepath.Join(dir, "data")
+	index := filepath.Join(dir, "index")
+
+	w, err := bufpipe.OpenLineIndexedFilePipe(data, index, 0666, bufpipe.WithPreallocate(4096))
+	if err != nil {
+		t.Fatal("Unable to open writer", err)
+	}
+	defer w.Close()
+	writeNumberedLines(t, w, 0, 12)
+	size, _ := w.DataSize()
+
+	// The unused space of the open writer is not taken for lines
+	r, err := bufpipe.OpenLineIndexedFilePipeReadOnly(data, index)
+	if err != nil {
+		t.Fatal("Unable to open reader", err)
+	}
+	defer r.Close()
+	if n, err := r.CountLines(); n != 12 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 12, nil, n, err)
+	}
+	if n, err := r.DataSize(); n != size || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", size, nil, n, err)
+	}
+	testSeekLines(t, r.LineIndexedPipe, 12)
+
+	f, err := bufpipe.OpenLineIndexedFilePipe(data, index, 0666, bufpipe.WithFollow(10*time.Millisecond))
+	if err != nil {
+		t.Fatal("Unable to open follower", err)
+	}
+	defer f.Close()
+
+	writeNumberedLines(t, w, 12, 20)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if lines, _ := f.CountLines(); lines == 20 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for lines to be indexed")
+		}
+	}
+	testSeekLines(t, f.LineIndexedPipe, 20)
+}
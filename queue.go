@@ -0,0 +1,438 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultVisibilityTimeout is how long a worker has to Ack a line before it is redelivered
+const DefaultVisibilityTimeout = 30 * time.Second
+
+// Queue hands out the lines of a LineIndexedPipe to competing workers, each line going to one
+// worker at a time. A line is redelivered if the worker Nacks it or does not Ack it within the
+// visibility timeout, so every line is processed at least once. Lines that keep failing can be
+// moved to a dead letter pipe, see WithDeadLetter.
+type Queue struct {
+	fresh   chan *Message
+	done    chan struct{}
+	stopped chan struct{} // closed once read returns
+	reader  *Consumer
+	timeout time.Duration
+	dead    io.Writer
+	tries   int
+	commit  *Consumer // records the lines acked, nil if not durable
+
+	cl        sync.Mutex // serialises commits, protects commit and committed
+	committed int64      // mark last committed
+
+	mu      sync.Mutex
+	wake    chan struct{} // closed when a line is ready to be redelivered
+	pending map[int64]*pending
+	retry   []int64         // lines ready to be redelivered
+	acked   map[int64]int64 // end offsets of lines acked after mark
+	mark    int64           // every line before it has been acked
+	offset  int64           // offset mark starts at
+	err     error           // stopped reading new lines
+	closed  bool
+}
+
+// Message is a line delivered by a Queue
+type Message struct {
+	Line       int64
+	Data       []byte // the line including its delimiter
+	Deliveries int    // times the line has been delivered, including this one
+
+	offset int64
+}
+
+// pending is a line delivered and not yet acked
+type pending struct {
+	data       []byte
+	offset     int64
+	deliveries int
+	deadline   time.Time
+	ready      bool // waiting to be redelivered
+	dead       bool // being moved to the dead letter pipe
+}
+
+// QueueOption configures a Queue
+type QueueOption func(*queueOptions)
+
+type queueOptions struct {
+	visibility time.Duration
+	dead       io.Writer
+	deliveries int
+}
+
+func newQueueOptions(opts []QueueOption) *queueOptions {
+	o := &queueOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithVisibilityTimeout sets how long a Queue waits for a line to be acked before redelivering
+// it, DefaultVisibilityTimeout if not set
+func WithVisibilityTimeout(timeout time.Duration) QueueOption {
+	return func(o *queueOptions) {
+		o.visibility = timeout
+	}
+}
+
+// WithDeadLetter moves a line from a Queue to dead once it has failed to be processed the given
+// number of times, instead of redelivering it
+func WithDeadLetter(dead io.Writer, deliveries int) QueueOption {
+	return func(o *queueOptions) {
+		o.dead = dead
+		o.deliveries = deliveries
+	}
+}
+
+// OpenQueue returns a Queue of the lines of pipe from the first. Which lines are acked is only
+// held in memory, see LineIndexedFilePipe.OpenQueue for a durable queue.
+func OpenQueue(pipe *LineIndexedPipe, opts ...QueueOption) (*Queue, error) {
+	// The delimiter is known once the index is read
+	if _, err := pipe.CountLines(); err != nil {
+		return nil, err
+	}
+
+	return openQueue(&Consumer{pipe: pipe.Pipe, delim: pipe.format.Delimiter}, nil, newQueueOptions(opts)), nil
+}
+
+// OpenQueue returns the named Queue of the lines of the pipe. Lines are acked durably, a queue
+// opened again with the same name resumes from the first line not acked. It shares its name
+// and position with the consumer of the same name, see OpenConsumer.
+func (l *LineIndexedFilePipe) OpenQueue(name string, opts ...QueueOption) (*Queue, error) {
+	c, err := l.OpenConsumer(name)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := *c
+	return openQueue(&reader, c, newQueueOptions(opts)), nil
+}
+
+func openQueue(reader, commit *Consumer, o *queueOptions) *Queue {
+	q := &Queue{
+		fresh:   make(chan *Message),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		reader:  reader,
+		timeout: o.visibility,
+		dead:    o.dead,
+		tries:   o.deliveries,
+		commit:  commit,
+		wake:    make(chan struct{}),
+		pending: make(map[int64]*pending),
+		acked:   make(map[int64]int64),
+		mark:    reader.line,
+		offset:  reader.offset,
+
+		committed: reader.line,
+	}
+	if q.timeout <= 0 {
+		q.timeout = DefaultVisibilityTimeout
+	}
+	reader.stop = q.done
+
+	go q.read(reader)
+
+	return q
+}
+
+// read passes new lines to Receive until the pipe or queue is closed
+func (q *Queue) read(reader *Consumer) {
+	defer close(q.stopped)
+
+	for {
+		line, offset := reader.Position()
+		data, err := reader.ReadLine()
+		if err != nil {
+			q.mu.Lock()
+			q.err = err
+			q.mu.Unlock()
+			close(q.fresh)
+			return
+		}
+
+		select {
+		case q.fresh <- &Message{Line: line, Data: data, offset: offset}:
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// Receive returns the next line to be processed, blocking until there is one or ctx is done.
+// Lines to be redelivered come before new lines. Once the pipe is closed it returns the error
+// the pipe stopped with when there are no more lines to be delivered.
+func (q *Queue) Receive(ctx context.Context) (*Message, error) {
+	fresh := q.fresh
+	for {
+		now := time.Now()
+
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return nil, io.ErrClosedPipe
+		}
+		m, dead := q.redeliver(now)
+		q.mu.Unlock()
+
+		// Lines not moved to the dead letter pipe are tried again by the next Receive
+		err := q.bury(dead)
+		if m != nil {
+			return m, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		q.mu.Lock()
+		if fresh == nil && len(q.pending) == 0 {
+			err = q.err
+			q.mu.Unlock()
+			return nil, err
+		}
+		wake, expires := q.wake, q.expires()
+		q.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !expires.IsZero() {
+			timer = time.NewTimer(expires.Sub(now))
+			timeout = timer.C
+		}
+
+		var ok bool
+		select {
+		case m, ok = <-fresh:
+			if !ok {
+				fresh = nil
+			}
+		case <-wake:
+		case <-timeout:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+
+			p := &pending{data: m.Data, offset: m.offset}
+			q.pending[m.Line] = p
+			return q.deliver(m.Line, p, time.Now()), nil
+		}
+	}
+}
+
+// Ack records that a line has been processed, it is not delivered again. Acking a line already
+// acked, including one redelivered after the visibility timeout, or one being moved to the dead
+// letter pipe does nothing.
+func (q *Queue) Ack(m *Message) error {
+	q.mu.Lock()
+	if p, ok := q.pending[m.Line]; ok && p.dead {
+		q.mu.Unlock()
+		return nil
+	}
+	moved := q.ack(m.Line)
+	q.mu.Unlock()
+
+	if moved {
+		return q.save()
+	}
+	return nil
+}
+
+// Nack returns a line that could not be processed to be redelivered, or moved to the dead
+// letter pipe if it has been delivered too many times. Nacking a line that has since been
+// redelivered does nothing.
+func (q *Queue) Nack(m *Message) error {
+	q.mu.Lock()
+	p, ok := q.pending[m.Line]
+	if !ok || p.ready || p.dead || p.deliveries != m.Deliveries {
+		q.mu.Unlock()
+		return nil
+	}
+	dead := q.fail(m.Line, p)
+	q.mu.Unlock()
+
+	if dead {
+		return q.bury([]int64{m.Line})
+	}
+	return nil
+}
+
+// Close stops the queue, lines not acked are delivered again by a queue opened with the same
+// name. It does not close the pipe.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.done)
+		close(q.wake)
+	}
+	q.mu.Unlock()
+
+	// Wake the reader if it is waiting for a line, and wait for it to stop
+	q.reader.pipe.wake()
+	<-q.stopped
+
+	return nil
+}
+
+// redeliver returns the next line to be redelivered, first failing lines whose visibility
+// timeout has expired in order, and the lines to be moved to the dead letter pipe. The caller
+// must hold mu.
+func (q *Queue) redeliver(now time.Time) (m *Message, dead []int64) {
+	var expired []int64
+	for line, p := range q.pending {
+		if !p.ready && !p.dead && !p.deadline.After(now) {
+			expired = append(expired, line)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i] < expired[j] })
+	for _, line := range expired {
+		if q.fail(line, q.pending[line]) {
+			dead = append(dead, line)
+		}
+	}
+
+	for len(q.retry) > 0 {
+		line := q.retry[0]
+		q.retry = q.retry[1:]
+		if p, ok := q.pending[line]; ok && p.ready {
+			return q.deliver(line, p, now), dead
+		}
+	}
+
+	return nil, dead
+}
+
+// expires returns when the first visibility timeout expires, zero if there are none. The caller
+// must hold mu.
+func (q *Queue) expires() (first time.Time) {
+	for _, p := range q.pending {
+		if !p.ready && !p.dead && (first.IsZero() || p.deadline.Before(first)) {
+			first = p.deadline
+		}
+	}
+	return
+}
+
+// deliver returns a line as a new Message. The caller must hold mu.
+func (q *Queue) deliver(line int64, p *pending, now time.Time) *Message {
+	p.deliveries++
+	p.deadline = now.Add(q.timeout)
+	p.ready = false
+	return &Message{Line: line, Data: p.data, Deliveries: p.deliveries, offset: p.offset}
+}
+
+// fail readies a line to be redelivered, or reports it is to be moved to the dead letter pipe
+// if it has been delivered too many times, see bury. The caller must hold mu.
+func (q *Queue) fail(line int64, p *pending) (dead bool) {
+	if q.dead != nil && p.deliveries >= q.tries {
+		p.dead = true
+		return true
+	}
+
+	p.ready = true
+	q.retry = append(q.retry, line)
+	if !q.closed {
+		close(q.wake)
+		q.wake = make(chan struct{})
+	}
+	return false
+}
+
+// bury writes lines failed to the dead letter pipe without holding mu, so a slow dead letter
+// pipe does not hold up the queue, acking each once written. Lines that are not written are
+// moved by a later Receive.
+func (q *Queue) bury(lines []int64) (err error) {
+	for i, line := range lines {
+		q.mu.Lock()
+		p := q.pending[line]
+		q.mu.Unlock()
+
+		_, err = q.dead.Write(p.data)
+
+		q.mu.Lock()
+		var moved bool
+		if err == nil {
+			moved = q.ack(line)
+		} else {
+			p.dead = false
+			for _, line := range lines[i+1:] {
+				q.pending[line].dead = false
+			}
+		}
+		q.mu.Unlock()
+
+		if err != nil {
+			return
+		}
+		if moved {
+			if err = q.save(); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// ack records a line as processed, reporting whether the first line not acked moved and needs
+// to be committed, see save. The caller must hold mu.
+func (q *Queue) ack(line int64) bool {
+	p, ok := q.pending[line]
+	if !ok {
+		return false
+	}
+	delete(q.pending, line)
+	q.acked[line] = p.offset + int64(len(p.data))
+
+	mark := q.mark
+	for end, ok := q.acked[q.mark]; ok; end, ok = q.acked[q.mark] {
+		delete(q.acked, q.mark)
+		q.mark++
+		q.offset = end
+	}
+
+	return q.commit != nil && q.mark != mark
+}
+
+// save commits the first line not acked without holding mu, so syncing the commit to disk does
+// not hold up the queue. A commit behind one already made is skipped.
+func (q *Queue) save() error {
+	q.cl.Lock()
+	defer q.cl.Unlock()
+
+	q.mu.Lock()
+	line, offset := q.mark, q.offset
+	q.mu.Unlock()
+
+	if line <= q.committed {
+		return nil
+	}
+
+	q.commit.line, q.commit.offset = line, offset
+	if err := q.commit.Commit(); err != nil {
+		return err
+	}
+	q.committed = line
+
+	return nil
+}
@@ -0,0 +1,306 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Ladbrokes/bufpipe"
+)
+
+func openQueue(t *testing.T, opts ...bufpipe.QueueOption) (*bufpipe.LineIndexedPipe, *bufpipe.Queue) {
+	p, err := bufpipe.OpenLineIndexedStoragePipe(bufpipe.NewMemoryStorage(), bufpipe.NewMemoryStorage())
+	if err != nil {
+		t.Fatal("Unable to open pipe", err)
+	}
+	q, err := bufpipe.OpenQueue(p, opts...)
+	if err != nil {
+		t.Fatal("Unable to open queue", err)
+	}
+	return p, q
+}
+
+func receive(t *testing.T, q *bufpipe.Queue, line int64, deliveries int) *bufpipe.Message {
+	m, err := q.Receive(context.Background())
+	if err != nil || m.Line != line || m.Deliveries != deliveries {
+		t.Fatalf("Expected [%v, %v, %v] got [%v, %+v]", nil, line, deliveries, err, m)
+	}
+	if expect := fmt.Sprintf("line %d\n", line); string(m.Data) != expect {
+		t.Errorf("Expected %q got %q", expect, m.Data)
+	}
+	return m
+}
+
+func TestQueueCompetingWorkers(t *testing.T) {
+	p, q := openQueue(t)
+	defer q.Close()
+	writeNumberedLines(t, p, 0, 100)
+
+	var l sync.Mutex
+	seen := make(map[int64]int)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+				m, err := q.Receive(ctx)
+				cancel()
+				if err != nil {
+					return
+				}
+				l.Lock()
+				seen[m.Line]++
+				l.Unlock()
+				q.Ack(m)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for line := int64(0); line < 100; line++ {
+		if seen[line] != 1 {
+			t.Errorf("Expected line %d to be delivered once, got %d", line, seen[line])
+		}
+	}
+}
+
+func TestQueueRedelivery(t *testing.T) {
+	p, q := openQueue(t, bufpipe.WithVisibilityTimeout(20*time.Millisecond))
+	writeNumberedLines(t, p, 0, 1)
+
+	// Nacked lines come before new lines
+	m := receive(t, q, 0, 1)
+	writeNumberedLines(t, p, 1, 3)
+	q.Nack(m)
+	receive(t, q, 0, 2)
+	receive(t, q, 1, 1)
+	q.Ack(receive(t, q, 2, 1))
+
+	// Lines not acked in time are redelivered
+	start := time.Now()
+	m = receive(t, q, 0, 3)
+	if waited := time.Since(start); waited < 10*time.Millisecond {
+		t.Errorf("Expected to wait for the visibility timeout, waited %v", waited)
+	}
+	m1 := receive(t, q, 1, 2)
+
+	// Late acks and nacks of an earlier delivery
+	q.Nack(&bufpipe.Message{Line: 0, Deliveries: 2})
+	q.Ack(&bufpipe.Message{Line: 1, Deliveries: 1})
+	q.Ack(m)
+	q.Nack(m1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if m, err := q.Receive(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v got [%v, %+v]", context.DeadlineExceeded, err, m)
+	}
+
+	q.Close()
+	if _, err := q.Receive(context.Background()); err != io.ErrClosedPipe {
+		t.Errorf("Expected %v got %v", io.ErrClosedPipe, err)
+	}
+}
+
+func TestQueueDeadLetter(t *testing.T) {
+	dead := bufpipe.NewStoragePipe(bufpipe.NewMemoryStorage())
+	p, q := openQueue(t, bufpipe.WithDeadLetter(dead, 2))
+	defer q.Close()
+	writeNumberedLines(t, p, 0, 2)
+
+	q.Nack(receive(t, q, 0, 1))
+	q.Nack(receive(t, q, 0, 2))
+	q.Ack(receive(t, q, 1, 1))
+
+	d := make([]byte, 20)
+	if n, err := dead.Read(d); err != nil || string(d[:n]) != "line 0\n" {
+		t.Errorf("Expected [%v, %q] got [%v, %q]", nil, "line 0\n", err, string(d[:n]))
+	}
+
+	// The pipe closing ends the queue once the lines delivered are acked
+	p.Close()
+	if _, err := q.Receive(context.Background()); err != io.ErrClosedPipe {
+		t.Errorf("Expected %v got %v", io.ErrClosedPipe, err)
+	}
+}
+
+// blockingWriter is a dead letter pipe that blocks writes until released
+type blockingWriter struct {
+	written chan []byte
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	w.written <- append([]byte(nil), p...)
+	<-w.release
+	return len(p), nil
+}
+
+func TestQueueDeadLetterBlocked(t *testing.T) {
+	dead := &blockingWriter{written: make(chan []byte, 1), release: make(chan struct{})}
+	p, q := openQueue(t, bufpipe.WithDeadLetter(dead, 1))
+	defer q.Close()
+	writeNumberedLines(t, p, 0, 2)
+
+	m := receive(t, q, 0, 1)
+	nacked := make(chan error)
+	go func() { nacked <- q.Nack(m) }()
+	if d := <-dead.written; string(d) != "line 0\n" {
+		t.Errorf("Expected %q got %q", "line 0\n", d)
+	}
+
+	// The queue goes on while the dead letter pipe is blocked
+	received := make(chan *bufpipe.Message, 1)
+	go func() {
+		m, _ := q.Receive(context.Background())
+		q.Ack(m)
+		received <- m
+	}()
+	select {
+	case m := <-received:
+		if m.Line != 1 {
+			t.Errorf("Expected line %v got %+v", 1, m)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the queue not to wait for the dead letter pipe")
+	}
+
+	close(dead.release)
+	if err := <-nacked; err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestQueueCloseStopsReading(t *testing.T) {
+	p, err := bufpipe.OpenLineIndexedStoragePipe(bufpipe.NewMemoryStorage(), bufpipe.NewMemoryStorage())
+	if err != nil {
+		t.Fatal("Unable to open pipe", err)
+	}
+	defer p.Close()
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		q, err := bufpipe.OpenQueue(p)
+		if err != nil {
+			t.Fatal("Unable to open queue", err)
+		}
+		q.Close()
+	}
+
+	// Close waits for the reader to return, it may be counted until it exits
+	var after int
+	for i := 0; i < 100; i++ {
+		if after = runtime.NumGoroutine(); after <= before {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after > before {
+		t.Errorf("Expected %v goroutines got %v", before, after)
+	}
+}
+
+func TestQueueDurable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testqueue")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, index := filepath.Join(dir, "data"), filepath.Join(dir, "index")
+	p, err := bufpipe.OpenLineIndexedFilePipe(data, index, 0666)
+	if err != nil {
+		t.Fatal("Unable to open pipe", err)
+	}
+	writeNumberedLines(t, p, 0, 5)
+
+	q, err := p.OpenQueue("work")
+	if err != nil {
+		t.Fatal("Unable to open queue", err)
+	}
+	q.Ack(receive(t, q, 0, 1))
+	receive(t, q, 1, 1)
+	q.Ack(receive(t, q, 2, 1))
+	q.Close()
+	p.Close()
+
+	if p, err = bufpipe.OpenLineIndexedFilePipe(data, index, 0666); err != nil {
+		t.Fatal("Unable to open pipe", err)
+	}
+	defer p.Close()
+
+	if consumers, err := p.Consumers(); err != nil || len(consumers) != 1 || consumers[0].Line != 1 {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", nil, 1, err, consumers)
+	}
+
+	// Lines are resumed from the first not acked
+	if q, err = p.OpenQueue("work"); err != nil {
+		t.Fatal("Unable to open queue", err)
+	}
+	defer q.Close()
+	q.Ack(receive(t, q, 1, 1))
+	q.Ack(receive(t, q, 2, 1))
+	receive(t, q, 3, 1)
+
+	if consumers, err := p.Consumers(); err != nil || len(consumers) != 1 || consumers[0].Line != 3 {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", nil, 3, err, consumers)
+	}
+}
+
+func TestQueueDurableCompetingWorkers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testqueue")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, err := bufpipe.OpenLineIndexedFilePipe(filepath.Join(dir, "data"), filepath.Join(dir, "index"), 0666)
+	if err != nil {
+		t.Fatal("Unable to open pipe", err)
+	}
+	defer p.Close()
+	writeNumberedLines(t, p, 0, 100)
+
+	q, err := p.OpenQueue("work")
+	if err != nil {
+		t.Fatal("Unable to open queue", err)
+	}
+	defer q.Close()
+
+	// Commits made outside the queue lock never go backwards
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+				m, err := q.Receive(ctx)
+				cancel()
+				if err != nil {
+					return
+				}
+				if err := q.Ack(m); err != nil {
+					t.Errorf("Unexpected error %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if consumers, err := p.Consumers(); err != nil || len(consumers) != 1 || consumers[0].Line != 100 {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", nil, 100, err, consumers)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe
+
+import (
+	"errors"
+	"os"
+	"sync"
+)
+
+// ErrReadOnly is returned when writing to a pipe opened read only
+var ErrReadOnly = errors.New("pipe is read only")
+
+// ErrLocked is returned when opening a file pipe for writing while another holds the writer lock
+var ErrLocked = errors.New("pipe is locked by another writer")
+
+// WithReadOnly opens a pipe read only, so that a pipe being written by another process can be
+// read. It applies to any Storage passed to the Open functions as well as to files opened by name.
+// Writes fail with ErrReadOnly, and a file pipe does not take the writer lock. See WithFollow to
+// pick up what is written after opening.
+func WithReadOnly() Option {
+	return func(o *options) {
+		o.readOnly = true
+	}
+}
+
+// readOnlyStorage is Storage written by another process. Truncating it only hides what follows
+// from Size until the storage changes size, so a partially written index entry is ignored
+// until it is complete rather than cut from the index being written.
+type readOnlyStorage struct {
+	s Storage
+
+	mu     sync.Mutex
+	hidden int64 // size of the storage when truncated, 0 if not
+	limit  int64
+}
+
+// readOnlyFileStorage is readOnlyStorage of a file
+type readOnlyFileStorage struct {
+	*readOnlyStorage
+	f *os.File
+}
+
+func newReadOnlyStorage(s Storage) Storage {
+	if s == nil {
+		return nil
+	}
+	r := &readOnlyStorage{s: s}
+	if f, ok := s.(interface{ file() *os.File }); ok {
+		return &readOnlyFileStorage{readOnlyStorage: r, f: f.file()}
+	}
+	return r
+}
+
+func (s *readOnlyFileStorage) file() *os.File {
+	return s.f
+}
+
+func (s *readOnlyStorage) ReadAt(p []byte, off int64) (int, error) {
+	return s.s.ReadAt(p, off)
+}
+
+func (s *readOnlyStorage) Append(p []byte) (int, error) {
+	return 0, ErrReadOnly
+}
+
+func (s *readOnlyStorage) Size() (int64, error) {
+	size, err := s.s.Size()
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if size == s.hidden {
+		return s.limit, nil
+	}
+	s.hidden = 0
+	return size, nil
+}
+
+func (s *readOnlyStorage) Truncate(size int64) error {
+	current, err := s.s.Size()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if size < current {
+		s.hidden, s.limit = current, size
+	}
+	return nil
+}
+
+func (s *readOnlyStorage) Sync() error {
+	return nil
+}
+
+func (s *readOnlyStorage) Close() error {
+	return s.s.Close()
+}
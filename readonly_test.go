@@ -0,0 +1,89 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe_test
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Ladbrokes/bufpipe"
+)
+
+func TestLineIndexedFilePipeReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testreadonly")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, index := filepath.Join(dir, "data"), filepath.Join(dir, "index")
+
+	// Misspelled paths are not created
+	if _, err := bufpipe.OpenLineIndexedFilePipeReadOnly(data, index); !os.IsNotExist(err) {
+		t.Errorf("Expected not exist got %v", err)
+	}
+	if _, err := os.Stat(data); !os.IsNotExist(err) {
+		t.Errorf("Expected the data not to be created, got %v", err)
+	}
+
+	for _, test := range []struct {
+		name string
+		opt  bufpipe.Option
+	}{
+		{"dense", bufpipe.WithSync(bufpipe.SyncAlways)},
+		{"sparse", bufpipe.WithSparseIndex(bufpipe.IndexInterval{Lines: 4})},
+		{"compact", bufpipe.WithCompactIndex(4)},
+	} {
+		data, index := filepath.Join(dir, test.name+".data"), filepath.Join(dir, test.name+".index")
+		w, err := bufpipe.OpenLineIndexedFilePipe(data, index, 0666, test.opt)
+		if err != nil {
+			t.Fatal("Unable to open pipe", err)
+		}
+		writeNumberedLines(t, w, 0, 20)
+		w.Close()
+
+		// Lines the index is missing, as if the writer stopped before indexing them
+		f, _ := os.OpenFile(data, os.O_APPEND|os.O_WRONLY, 0)
+		for i := 20; i < 25; i++ {
+			fmt.Fprintf(f, "line %d\n", i)
+		}
+		f.WriteString("partial")
+		f.Close()
+		indexSize := fileSize(t, index)
+
+		p, err := bufpipe.OpenLineIndexedFilePipeReadOnly(data, index)
+		if err != nil {
+			t.Fatalf("%s: unable to open read only %v", test.name, err)
+		}
+
+		if lines, err := p.CountLines(); err != nil || lines != 25 {
+			t.Errorf("%s: expected [%v, %v] got [%v, %v]", test.name, nil, 25, err, lines)
+		}
+		testSeekLines(t, p.LineIndexedPipe, 25)
+		for _, line := range []int64{20, 24} {
+			p.SeekLine(line)
+			scanner := bufio.NewScanner(p)
+			scanner.Scan()
+			if expect := fmt.Sprintf("line %d", line); scanner.Text() != expect {
+				t.Errorf("%s: expected %v got %v", test.name, expect, scanner.Text())
+			}
+		}
+		if err := p.SeekLine(25); err == nil {
+			t.Errorf("%s: expected an error seeking past the last line", test.name)
+		}
+
+		if _, err := p.Write([]byte("line 25\n")); err != bufpipe.ErrReadOnly {
+			t.Errorf("%s: expected %v got %v", test.name, bufpipe.ErrReadOnly, err)
+		}
+		p.Close()
+
+		if n := fileSize(t, index); n != indexSize {
+			t.Errorf("%s: expected the index to be unchanged, %v got %v", test.name, indexSize, n)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package bufpipe
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// The most sendfile copies in one call
+const maxSendfile = 0x7ffff000
+
+// sendFile copies n bytes of f from off to w in the kernel when w is a socket or file. handled
+// is false if nothing was copied because w can not be written to this way, for example a file
+// opened for appending.
+func sendFile(w io.Writer, f *os.File, off, n int64) (written int64, handled bool, err error) {
+	sc, ok := w.(syscall.Conn)
+	if !ok {
+		return 0, false, nil
+	}
+	wc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+
+	cerr := rc.Control(func(in uintptr) {
+		werr := wc.Write(func(out uintptr) bool {
+			for written < n {
+				chunk := n - written
+				if chunk > maxSendfile {
+					chunk = maxSendfile
+				}
+				c, e := syscall.Sendfile(int(out), int(in), &off, int(chunk))
+				if c > 0 {
+					written += int64(c)
+				}
+				switch {
+				case e == syscall.EAGAIN:
+					return false // wait until w can be written to
+				case e == syscall.EINTR:
+				case e != nil:
+					err = e
+					return true
+				case c == 0:
+					err = io.ErrUnexpectedEOF
+					return true
+				}
+			}
+			return true
+		})
+		if err == nil {
+			err = werr
+		}
+	})
+	if err == nil {
+		err = cerr
+	}
+
+	if written == 0 && (err == syscall.EINVAL || err == syscall.ENOSYS || err == syscall.EOPNOTSUPP) {
+		return 0, false, nil
+	}
+	return written, true, err
+}
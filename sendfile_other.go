@@ -0,0 +1,16 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package bufpipe
+
+import (
+	"io"
+	"os"
+)
+
+func sendFile(w io.Writer, f *os.File, off, n int64) (written int64, handled bool, err error) {
+	return 0, false, nil
+}
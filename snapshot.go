@@ -0,0 +1,249 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ErrNotFile is returned when cloning a pipe whose Storages are not files
+var ErrNotFile = errors.New("storage is not a file")
+
+// Snapshot is a read only view of a LineIndexedPipe frozen at the end of a line. Writes append
+// to the data and index and a failed write is only undone back to where it started, so the part
+// of them in the snapshot does not change as the pipe goes on being written. That does not hold
+// for data released once read or dropped by FullDropOldest, which can no longer be read, for
+// Storage truncated by something else and found by Recover, or for an index replaced by
+// MigrateIndexFile.
+type Snapshot struct {
+	pipe      *LineIndexedPipe
+	lines     int64
+	size      int64
+	indexSize int64
+	timesSize int64
+	sumsSize  int64
+	chainSize int64
+	treeSize  int64
+}
+
+// Snapshot returns a view of the complete lines written so far and the index of them
+func (l *LineIndexedPipe) Snapshot() (*Snapshot, error) {
+	l.wl.Lock()
+	defer l.wl.Unlock()
+
+	l.l.Lock()
+	closed := l.closed
+	l.l.Unlock()
+	if closed {
+		return nil, io.ErrClosedPipe
+	}
+
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+
+	s := &Snapshot{
+		pipe:  l,
+		lines: l.lines,
+		size:  l.lastIndex,
+	}
+
+	var err error
+	if s.indexSize, err = l.index.Size(); err != nil {
+		return nil, pipeError("size", "index", err)
+	}
+	if l.times != nil {
+		if s.timesSize, err = l.times.Size(); err != nil {
+			return nil, pipeError("size", "times", err)
+		}
+	}
+	if l.sums != nil {
+		if s.sumsSize, err = l.sums.Size(); err != nil {
+			return nil, pipeError("size", "sums", err)
+		}
+	}
+	if l.chain != nil {
+		if s.chainSize, err = l.chain.Size(); err != nil {
+			return nil, pipeError("size", "chain", err)
+		}
+	}
+	if l.tree != nil {
+		if s.treeSize, err = l.tree.Size(); err != nil {
+			return nil, pipeError("size", "tree", err)
+		}
+	}
+
+	return s, nil
+}
+
+// Lines returns the number of lines in the snapshot
+func (s *Snapshot) Lines() int64 {
+	return s.lines
+}
+
+// Size returns the size of the data in the snapshot
+func (s *Snapshot) Size() int64 {
+	return s.size
+}
+
+// LineOffset returns the offset the given line starts at, io.EOF is returned if the line is not
+// in the snapshot
+func (s *Snapshot) LineOffset(line int64) (offset int64, err error) {
+	switch {
+	case line < 0 || line > s.lines:
+		return 0, io.EOF
+	case line == s.lines:
+		return s.size, nil
+	}
+
+	l := s.pipe
+	if l.mapped.isReady() {
+		if offset, err = l.mapped.find(line); err != nil {
+			err = pipeError("read", "index", err)
+		}
+		return
+	}
+
+	l.wl.Lock()
+	defer l.wl.Unlock()
+
+	if err = l.load(); err != nil {
+		return
+	}
+
+	return l.lineOffset(line)
+}
+
+// ReadAt implements the io.ReaderAt interface for the data in the snapshot
+func (s *Snapshot) ReadAt(p []byte, off int64) (int, error) {
+	return s.pipe.readAt(p, off, s.size)
+}
+
+// View returns a reader of the data in the snapshot, see Pipe.View
+func (s *Snapshot) View() io.ReadSeekCloser {
+	return newView(s, s.size)
+}
+
+// CloneTo writes the snapshot to files in dir named as those of the pipe, so that it can be
+// opened as a new pipe, see OpenLineIndexedFilePipe. A file named as one before it has a suffix
+// of what it holds added, such as "pipe.index" for an index named as the data "pipe". The files
+// must not already exist.
+//
+// Files are reflinked where the file system supports it and copied otherwise. They are not hard
+// linked as the pipe goes on writing to them.
+func (s *Snapshot) CloneTo(dir string) (err error) {
+	l := s.pipe
+	type clone struct {
+		side    string
+		storage Storage
+		size    int64
+	}
+	clones := []clone{
+		{"data", l.data, s.size},
+		{"index", l.index, s.indexSize},
+	}
+	if l.times != nil {
+		clones = append(clones, clone{"times", l.times, s.timesSize})
+	}
+	if l.sums != nil {
+		clones = append(clones, clone{"sums", l.sums, s.sumsSize})
+	}
+	if l.chain != nil {
+		clones = append(clones, clone{"chain", l.chain, s.chainSize})
+	}
+	if l.tree != nil {
+		clones = append(clones, clone{"tree", l.tree, s.treeSize})
+	}
+
+	var created []string
+	defer func() {
+		if err != nil {
+			for _, name := range created {
+				os.Remove(name)
+			}
+		}
+	}()
+
+	for i, c := range clones {
+		f, ok := c.storage.(interface{ file() *os.File })
+		if !ok {
+			return ErrNotFile
+		}
+
+		src := f.file()
+		name := filepath.Join(dir, filepath.Base(src.Name()))
+		for _, n := range created {
+			if n == name {
+				name += "." + c.side
+				break
+			}
+		}
+		if err = cloneFile(src, name, c.size); err != nil {
+			if !os.IsExist(err) {
+				created = append(created, name)
+			}
+			return
+		}
+		created = append(created, name)
+
+		// Clear the flags of a preallocated index, as the clone is complete
+		if i == 1 && c.size >= indexHeaderSize && !l.legacy {
+			var dst *os.File
+			if dst, err = os.OpenFile(name, os.O_WRONLY, 0); err != nil {
+				return
+			}
+			err = setIndexFlags(dst, 0)
+			if cerr := dst.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// cloneFile creates the named file with the first size bytes of src
+func cloneFile(src *os.File, name string, size int64) (err error) {
+	info, err := src.Stat()
+	if err != nil {
+		return
+	}
+
+	dst, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return
+	}
+	defer func() {
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	if err = reflink(dst, src); err == nil {
+		if err = dst.Truncate(size); err != nil {
+			return
+		}
+		return dst.Sync()
+	}
+
+	var n int64
+	var handled bool
+	if n, handled, err = sendFile(dst, src, 0, size); !handled {
+		n, err = io.Copy(dst, io.NewSectionReader(src, 0, size))
+	}
+	if err != nil {
+		return
+	}
+	if n < size {
+		return io.ErrUnexpectedEOF
+	}
+
+	return dst.Sync()
+}
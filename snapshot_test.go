@@ -0,0 +1,195 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Ladbrokes/bufpipe"
+)
+
+func TestSnapshot(t *testing.T) {
+	p, err := bufpipe.OpenLineIndexedStoragePipe(bufpipe.NewMemoryStorage(), bufpipe.NewMemoryStorage())
+	if err != nil {
+		t.Fatal("Unable to open pipe", err)
+	}
+	p.Write([]byte("a\nbb\nccc"))
+
+	s, err := p.Snapshot()
+	if err != nil {
+		t.Fatal("Unable to take snapshot", err)
+	}
+	p.Write([]byte("\ndddd\n"))
+
+	if s.Lines() != 2 || s.Size() != 5 {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 2, 5, s.Lines(), s.Size())
+	}
+
+	for _, test := range []struct {
+		line   int64
+		offset int64
+		err    error
+	}{
+		{0, 0, nil},
+		{1, 2, nil},
+		{2, 5, nil},
+		{3, 0, io.EOF},
+		{-1, 0, io.EOF},
+	} {
+		if offset, err := s.LineOffset(test.line); err != test.err || offset != test.offset {
+			t.Errorf("Line %d expected [%v, %v] got [%v, %v]", test.line, test.err, test.offset, err, offset)
+		}
+	}
+
+	if d, err := ioutil.ReadAll(s.View()); err != nil || string(d) != "a\nbb\n" {
+		t.Errorf("Expected [%v, %q] got [%v, %q]", nil, "a\nbb\n", err, string(d))
+	}
+
+	if err := s.CloneTo(os.TempDir()); err != bufpipe.ErrNotFile {
+		t.Errorf("Expected %v got %v", bufpipe.ErrNotFile, err)
+	}
+
+	p.Close()
+	if _, err := p.Snapshot(); err != io.ErrClosedPipe {
+		t.Errorf("Expected %v got %v", io.ErrClosedPipe, err)
+	}
+}
+
+func TestSnapshotCloneTo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testclone")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		name string
+		opt  func(from string) bufpipe.Option
+	}{
+		{"plain", func(string) bufpipe.Option { return bufpipe.WithSync(bufpipe.SyncAlways) }},
+		{"prealloc", func(string) bufpipe.Option { return bufpipe.WithPreallocate(4096) }},
+		{"times", func(from string) bufpipe.Option { return bufpipe.WithTimeIndexFile(filepath.Join(from, "times")) }},
+	} {
+		from, to := filepath.Join(dir, test.name), filepath.Join(dir, test.name, "clone")
+		if err := os.MkdirAll(to, 0777); err != nil {
+			t.Fatal("Unable to create directory", err)
+		}
+
+		p, err := bufpipe.OpenLineIndexedFilePipe(filepath.Join(from, "data"), filepath.Join(from, "index"), 0666, test.opt(from))
+		if err != nil {
+			t.Fatalf("%s: unable to open pipe %v", test.name, err)
+		}
+		writeNumberedLines(t, p, 0, 20)
+		p.Write([]byte("partial"))
+
+		s, err := p.Snapshot()
+		if err != nil {
+			t.Fatalf("%s: unable to take snapshot %v", test.name, err)
+		}
+		writeNumberedLines(t, p, 20, 30)
+
+		if err := s.CloneTo(to); err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		if err := s.CloneTo(to); !os.IsExist(err) {
+			t.Errorf("%s: expected exists got %v", test.name, err)
+		}
+		p.Close()
+
+		c, err := bufpipe.OpenLineIndexedFilePipe(filepath.Join(to, "data"), filepath.Join(to, "index"), 0666)
+		if err != nil {
+			t.Fatalf("%s: unable to open clone %v", test.name, err)
+		}
+		if lines, err := c.CountLines(); err != nil || lines != 20 {
+			t.Errorf("%s: expected [%v, %v] got [%v, %v]", test.name, nil, 20, err, lines)
+		}
+		if size, err := c.DataSize(); err != nil || size != s.Size() {
+			t.Errorf("%s: expected [%v, %v] got [%v, %v]", test.name, nil, s.Size(), err, size)
+		}
+		testSeekLines(t, c.LineIndexedPipe, 20)
+		c.Close()
+
+		if test.name == "times" {
+			if n := fileSize(t, filepath.Join(to, "times")); n != 20*8 {
+				t.Errorf("Expected %v got %v", 20*8, n)
+			}
+		}
+	}
+}
+
+func TestSnapshotCloneToLegacy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testclone")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	from, to := filepath.Join(dir, "from"), filepath.Join(dir, "to")
+	os.Mkdir(from, 0777)
+	os.Mkdir(to, 0777)
+
+	index := append(append([]byte{}, legacyIndex...), 14, 0, 0, 0, 0, 0, 0, 0)
+	ioutil.WriteFile(filepath.Join(from, "data"), []byte("\nHello World\n\nAgain\n"), 0666)
+	ioutil.WriteFile(filepath.Join(from, "index"), index, 0666)
+
+	p, err := bufpipe.OpenLineIndexedFilePipe(filepath.Join(from, "data"), filepath.Join(from, "index"), 0666)
+	if err != nil {
+		t.Fatal("Unable to open pipe", err)
+	}
+	defer p.Close()
+
+	s, err := p.Snapshot()
+	if err != nil {
+		t.Fatal("Unable to take snapshot", err)
+	}
+	if err := s.CloneTo(to); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	// A legacy index has no header to clear the flags of
+	if b, err := ioutil.ReadFile(filepath.Join(to, "index")); err != nil || !bytes.Equal(index, b) {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", index, nil, b, err)
+	}
+}
+
+func TestSnapshotCloneToSameName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testclone")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, index, to := filepath.Join(dir, "data"), filepath.Join(dir, "index"), filepath.Join(dir, "clone")
+	for _, d := range []string{data, index, to} {
+		os.Mkdir(d, 0777)
+	}
+
+	p, err := bufpipe.OpenLineIndexedFilePipe(filepath.Join(data, "pipe"), filepath.Join(index, "pipe"), 0666)
+	if err != nil {
+		t.Fatal("Unable to open pipe", err)
+	}
+	defer p.Close()
+	writeNumberedLines(t, p, 0, 20)
+
+	s, err := p.Snapshot()
+	if err != nil {
+		t.Fatal("Unable to take snapshot", err)
+	}
+	if err := s.CloneTo(to); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	// The index is named apart from the data
+	c, err := bufpipe.OpenLineIndexedFilePipe(filepath.Join(to, "pipe"), filepath.Join(to, "pipe.index"), 0666)
+	if err != nil {
+		t.Fatal("Unable to open clone", err)
+	}
+	defer c.Close()
+	testSeekLines(t, c.LineIndexedPipe, 20)
+}
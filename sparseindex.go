@@ -0,0 +1,168 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+)
+
+// IndexInterval sets how often a sparse index records a checkpoint. A checkpoint is recorded
+// for the first line that starts at least Lines lines or Bytes bytes after the previous one,
+// a zero value disables that limit. With both limits disabled every line is recorded.
+//
+// Larger intervals give a smaller index at the cost of scanning up to that many lines or
+// bytes of data on each SeekLine.
+type IndexInterval struct {
+	Lines int64
+	Bytes int64
+}
+
+// NewSparseLineIndexedPipe returns a new line indexed pipe structure that only records every
+// so many lines in the index, see IndexInterval. Each checkpoint is stored as a pair of little
+// endian int64s, the line number followed by its offset.
+// An existing index keeps the layout and interval it was created with.
+func NewSparseLineIndexedPipe(data, index io.ReadWriteSeeker, every IndexInterval) *LineIndexedPipe {
+	return newLineIndexedPipe(NewStorage(data), NewStorage(index), WithSparseIndex(every))
+}
+
+const sparseEntrySize = 2 * int64Size
+
+// sparseIndex stores a line number and offset pair for each checkpoint
+type sparseIndex struct {
+	s     Storage
+	start int64
+	base  int64
+	every IndexInterval
+
+	loaded     bool
+	entries    int64
+	lastLine   int64
+	lastOffset int64
+}
+
+func (s *sparseIndex) add(line, offset int64) (err error) {
+	if err = s.load(); err != nil {
+		return
+	}
+
+	due := s.entries == 0 ||
+		(s.every.Lines <= 0 && s.every.Bytes <= 0) ||
+		(s.every.Lines > 0 && line-s.lastLine >= s.every.Lines) ||
+		(s.every.Bytes > 0 && offset-s.lastOffset >= s.every.Bytes)
+	if !due {
+		return
+	}
+
+	buf := make([]byte, sparseEntrySize)
+	binary.LittleEndian.PutUint64(buf, uint64(line))
+	binary.LittleEndian.PutUint64(buf[int64Size:], uint64(offset-s.base))
+	if _, err = s.s.Append(buf); err != nil {
+		return
+	}
+
+	s.entries++
+	s.lastLine, s.lastOffset = line, offset
+
+	return
+}
+
+func (s *sparseIndex) find(line int64) (indexed, offset int64, err error) {
+	if err = s.load(); err != nil {
+		return
+	}
+
+	// First checkpoint after line, the one before it is the closest
+	i := sort.Search(int(s.entries), func(i int) bool {
+		if err != nil {
+			return true
+		}
+		var entry [2]int64
+		entry, err = s.entry(int64(i))
+		return entry[0] > line
+	})
+	if err != nil {
+		return
+	}
+	if i == 0 {
+		return 0, 0, io.EOF
+	}
+
+	var entry [2]int64
+	entry, err = s.entry(int64(i - 1))
+	return entry[0], entry[1], err
+}
+
+func (s *sparseIndex) last() (line, offset int64, err error) {
+	if err = s.load(); err != nil {
+		return
+	}
+	if s.entries == 0 {
+		return -1, 0, nil
+	}
+	return s.lastLine, s.lastOffset, nil
+}
+
+// load also drops a partially written entry from the end of the index
+func (s *sparseIndex) load() (err error) {
+	if s.loaded {
+		return
+	}
+
+	var size int64
+	if size, err = s.s.Size(); err != nil {
+		return
+	}
+
+	if torn := (size - s.start) % sparseEntrySize; torn != 0 {
+		if err = s.s.Truncate(size - torn); err != nil {
+			return
+		}
+	}
+
+	s.entries = 0
+	if err = s.read(size); err != nil {
+		return
+	}
+
+	s.loaded = true
+
+	return
+}
+
+func (s *sparseIndex) reload() (err error) {
+	if !s.loaded {
+		return s.load()
+	}
+
+	var size int64
+	if size, err = s.s.Size(); err != nil {
+		return
+	}
+	return s.read(size)
+}
+
+// read finds the entries in the first size bytes of the index, a partially written entry at the
+// end is left to be read once complete
+func (s *sparseIndex) read(size int64) (err error) {
+	entries := (size - s.start) / sparseEntrySize
+	if entries <= s.entries {
+		return
+	}
+
+	var entry [2]int64
+	if entry, err = s.entry(entries - 1); err != nil {
+		return
+	}
+	s.entries, s.lastLine, s.lastOffset = entries, entry[0], entry[1]
+
+	return
+}
+
+func (s *sparseIndex) entry(n int64) (entry [2]int64, err error) {
+	err = readAt(s.s, s.start+n*sparseEntrySize, &entry)
+	entry[1] += s.base
+	return
+}
@@ -0,0 +1,110 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe_test
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/Ladbrokes/bufpipe"
+	"github.com/Ladbrokes/bufpipe/mock"
+)
+
+func writeNumberedLines(t *testing.T, w io.Writer, from, to int) {
+	for i := from; i < to; i++ {
+		if _, err := fmt.Fprintf(w, "line %d\n", i); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+}
+
+func testSeekLines(t *testing.T, p *bufpipe.LineIndexedPipe, lines int) {
+	for _, line := range []int{0, 1, 9, 10, 11, lines / 2, lines - 1} {
+		if err := p.SeekLine(int64(line)); err != nil {
+			t.Fatalf("Unexpected error seeking line %d: %v", line, err)
+		}
+		scanner := bufio.NewScanner(p)
+		scanner.Scan()
+		if expect := fmt.Sprintf("line %d", line); scanner.Text() != expect {
+			t.Errorf("Expected %v got %v", expect, scanner.Text())
+		}
+	}
+}
+
+func TestSparseLineIndexedPipe(t *testing.T) {
+	data := &mock.ReadWriteSeekable{}
+	index := &mock.ReadWriteSeekable{}
+	p := bufpipe.NewSparseLineIndexedPipe(data, index, bufpipe.IndexInterval{Lines: 10})
+
+	writeNumberedLines(t, p, 0, 95)
+
+	// Header and checkpoints at lines 0, 10, ... 90
+	if n, err := p.IndexSize(); n != 32+10*16 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 32+10*16, nil, n, err)
+	}
+
+	if n, err := p.CountLines(); n != 95 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 95, nil, n, err)
+	}
+
+	testSeekLines(t, p, 95)
+
+	if err := p.SeekLine(95); err != io.EOF {
+		t.Errorf("Expected %v got %v", io.EOF, err)
+	}
+}
+
+func TestSparseBytesLineIndexedPipe(t *testing.T) {
+	index := &mock.ReadWriteSeekable{}
+	p := bufpipe.NewSparseLineIndexedPipe(&mock.ReadWriteSeekable{}, index, bufpipe.IndexInterval{Bytes: 64})
+
+	// Lines 0-9 are 7 bytes and the rest 8, so checkpoints at lines 0, 10 and 18
+	writeNumberedLines(t, p, 0, 20)
+	if n, err := p.IndexSize(); n != 32+3*16 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 32+3*16, nil, n, err)
+	}
+
+	testSeekLines(t, p, 20)
+}
+
+func TestSparseReopenLineIndexedPipe(t *testing.T) {
+	data := &mock.ReadWriteSeekable{}
+	index := &mock.ReadWriteSeekable{}
+	every := bufpipe.IndexInterval{Lines: 10}
+	p := bufpipe.NewSparseLineIndexedPipe(data, index, every)
+
+	writeNumberedLines(t, p, 0, 25)
+	p.Write([]byte("line 25"))
+
+	p = bufpipe.NewSparseLineIndexedPipe(mock.NewReadWriteSeekable(data.Bytes()), mock.NewReadWriteSeekable(index.Bytes()), every)
+	if n, err := p.CountLines(); n != 25 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 25, nil, n, err)
+	}
+
+	p.Write([]byte("\n"))
+	writeNumberedLines(t, p, 26, 35)
+
+	if n, err := p.IndexSize(); n != 32+4*16 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 32+4*16, nil, n, err)
+	}
+
+	testSeekLines(t, p, 35)
+}
+
+func TestSparseIndexSeekFailLineIndexedPipe(t *testing.T) {
+	index := &mock.ReadWriteSeekable{}
+	p := bufpipe.NewSparseLineIndexedPipe(&mock.ReadWriteSeekable{}, index, bufpipe.IndexInterval{})
+	index.SeekFunc = unseekableFunc
+
+	if n, err := p.CountLines(); n != 0 || !errors.Is(err, errUnseekable) {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 0, errUnseekable, n, err)
+	}
+
+	if err := p.SeekLine(0); !errors.Is(err, errUnseekable) {
+		t.Errorf("Expected %v got %v", errUnseekable, err)
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// SpillStorage is Storage held in memory until it grows past a threshold, after which further
+// data is appended to a temporary file. Data on either side of the threshold reads as one.
+type SpillStorage struct {
+	threshold int64
+	dir       string
+
+	al sync.Mutex // serialises appends and truncates
+
+	mu      sync.RWMutex // protects remaining fields
+	memory  *MemoryStorage
+	file    *os.File // nil until spilled
+	spill   Storage
+	memSize int64 // size of memory once spilled
+	size    int64
+}
+
+// NewSpillStorage returns Storage that is held in memory until appending would take it past
+// threshold bytes, then continues in a temporary file created in dir, or the default directory
+// for temporary files if dir is empty. The file is removed by Close.
+func NewSpillStorage(threshold int64, dir string) *SpillStorage {
+	return &SpillStorage{
+		threshold: threshold,
+		dir:       dir,
+		memory:    NewMemoryStorage(),
+	}
+}
+
+// Spilled reports whether data has been written to the temporary file
+func (s *SpillStorage) Spilled() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.spill != nil
+}
+
+// ReadAt implements the io.ReaderAt interface
+func (s *SpillStorage) ReadAt(p []byte, off int64) (n int, err error) {
+	s.mu.RLock()
+	spill, memSize := s.spill, s.memSize
+	s.mu.RUnlock()
+
+	if spill == nil {
+		return s.memory.ReadAt(p, off)
+	}
+
+	if off < memSize {
+		d := p
+		if int64(len(d)) > memSize-off {
+			d = d[:memSize-off]
+		}
+		if n, err = s.memory.ReadAt(d, off); n < len(d) {
+			return
+		}
+		err = nil
+	}
+
+	if n < len(p) {
+		var fn int
+		fn, err = spill.ReadAt(p[n:], off+int64(n)-memSize)
+		n += fn
+	}
+
+	return
+}
+
+// Append implements the Storage interface
+func (s *SpillStorage) Append(p []byte) (n int, err error) {
+	s.al.Lock()
+	defer s.al.Unlock()
+
+	s.mu.RLock()
+	spill, size := s.spill, s.size
+	s.mu.RUnlock()
+
+	if spill == nil && size+int64(len(p)) > s.threshold {
+		if spill, err = s.spillToFile(); err != nil {
+			return
+		}
+	}
+
+	if spill == nil {
+		n, err = s.memory.Append(p)
+	} else {
+		n, err = spill.Append(p)
+	}
+
+	s.mu.Lock()
+	s.size += int64(n)
+	s.mu.Unlock()
+
+	return
+}
+
+func (s *SpillStorage) spillToFile() (Storage, error) {
+	f, err := ioutil.TempFile(s.dir, "bufpipe")
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.file, s.spill, s.memSize = f, NewFileStorage(f), s.size
+
+	return s.spill, nil
+}
+
+// Size implements the Storage interface
+func (s *SpillStorage) Size() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.size, nil
+}
+
+// Truncate implements the Storage interface, once spilled data is still appended to the file
+func (s *SpillStorage) Truncate(size int64) (err error) {
+	s.al.Lock()
+	defer s.al.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if size >= s.size {
+		return
+	}
+
+	if s.spill != nil {
+		fileSize := size - s.memSize
+		if fileSize < 0 {
+			fileSize = 0
+		}
+		if err = s.spill.Truncate(fileSize); err != nil {
+			return
+		}
+		if size < s.memSize {
+			s.memSize = size
+		}
+	}
+
+	if err = s.memory.Truncate(size); err != nil {
+		return
+	}
+
+	s.size = size
+
+	return
+}
+
+// Sync implements the Storage interface, syncing the file once spilled
+func (s *SpillStorage) Sync() error {
+	s.mu.RLock()
+	spill := s.spill
+	s.mu.RUnlock()
+
+	if spill == nil {
+		return nil
+	}
+	return spill.Sync()
+}
+
+// Close implements the Storage interface, removing the file if spilled
+func (s *SpillStorage) Close() (err error) {
+	s.al.Lock()
+	defer s.al.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.memory.Close()
+	if s.file == nil {
+		return
+	}
+
+	err = s.file.Close()
+	if rerr := os.Remove(s.file.Name()); err == nil {
+		err = rerr
+	}
+	s.file, s.spill = nil, nil
+
+	return
+}
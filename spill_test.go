@@ -0,0 +1,75 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Ladbrokes/bufpipe"
+)
+
+func TestSpillStorage(t *testing.T) {
+	testStorage(t, bufpipe.NewSpillStorage(4, ""))
+	testStorage(t, bufpipe.NewSpillStorage(1024, ""))
+}
+
+func TestSpillStoragePipe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testspill")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := bufpipe.NewSpillStorage(1000, dir)
+	p := bufpipe.NewStoragePipe(s)
+	expect := pattern(3000)
+
+	p.Write(expect[:600])
+	if s.Spilled() {
+		t.Error("Expected to be held in memory")
+	}
+
+	p.Write(expect[600:])
+	if !s.Spilled() {
+		t.Error("Expected to have spilled to disk")
+	}
+
+	got := make([]byte, len(expect))
+	if _, err := io.ReadFull(p, got); err != nil || !bytes.Equal(expect, got) {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	// A read across the boundary
+	got = got[:100]
+	if n, err := s.ReadAt(got, 550); n != 100 || err != nil || !bytes.Equal(expect[550:650], got) {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 100, nil, n, err)
+	}
+
+	if err := s.Truncate(300); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	s.Append(expect[300:])
+	got = make([]byte, len(expect))
+	if n, err := s.ReadAt(got, 0); n != len(expect) || (err != nil && err != io.EOF) || !bytes.Equal(expect, got) {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", len(expect), nil, n, err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Expected the spill file to be removed, found %v", files)
+	}
+}
+
+func TestSpillStorageUncreatable(t *testing.T) {
+	s := bufpipe.NewSpillStorage(0, "/nonexistent/bufpipe")
+	if n, err := s.Append([]byte{1}); n != 0 || !os.IsNotExist(err) {
+		t.Errorf("Expected [%v, not exist] got [%v, %v]", 0, n, err)
+	}
+}
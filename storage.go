@@ -0,0 +1,171 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// Storage is an append only store read by position, the backend of every pipe.
+// ReadAt must be safe to call concurrently with itself and with Append.
+type Storage interface {
+	io.ReaderAt
+
+	// Append writes p to the end of the storage
+	Append(p []byte) (n int, err error)
+	// Size returns the size of the storage
+	Size() (int64, error)
+	// Truncate discards everything after the first size bytes
+	Truncate(size int64) error
+	// Sync commits appended data to stable storage, if the storage has any
+	Sync() error
+	// Close releases the storage
+	Close() error
+}
+
+// ErrTruncateUnsupported is returned when truncating a storage that can not be truncated
+var ErrTruncateUnsupported = errors.New("storage does not support truncate")
+
+// NewStorage returns the Storage for rws, Files are used directly and other ReadWriteSeekers
+// through NewSeekerStorage.
+func NewStorage(rws io.ReadWriteSeeker) Storage {
+	if f, ok := rws.(*os.File); ok {
+		return NewFileStorage(f)
+	}
+	return NewSeekerStorage(rws)
+}
+
+// fileStorage is Storage on an os.File, appends seek to the end so the file does not need to
+// be opened for appending
+type fileStorage struct {
+	f  *os.File
+	mu sync.Mutex // serialises appends
+}
+
+// NewFileStorage returns Storage for f, reads are made with pread so never wait on appends
+func NewFileStorage(f *os.File) Storage {
+	return &fileStorage{f: f}
+}
+
+func (s *fileStorage) file() *os.File {
+	return s.f
+}
+
+func (s *fileStorage) ReadAt(p []byte, off int64) (int, error) {
+	return s.f.ReadAt(p, off)
+}
+
+func (s *fileStorage) Append(p []byte) (n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err = s.f.Seek(0, os.SEEK_END); err != nil {
+		return
+	}
+	return s.f.Write(p)
+}
+
+func (s *fileStorage) Size() (int64, error) {
+	info, err := s.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *fileStorage) Truncate(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.f.Truncate(size)
+}
+
+func (s *fileStorage) Sync() error {
+	return s.f.Sync()
+}
+
+func (s *fileStorage) Close() error {
+	return s.f.Close()
+}
+
+// seekerStorage is Storage on a ReadWriteSeeker, sharing its offset under a lock
+type seekerStorage struct {
+	rws io.ReadWriteSeeker
+	at  io.ReaderAt // set if rws supports positional reads
+	mu  sync.Mutex  // protects the offset of rws
+}
+
+// NewSeekerStorage returns Storage for rws. Reads and appends take turns to seek, unless rws
+// is also an io.ReaderAt. Truncate, Sync and Close are passed on to rws if it implements them,
+// otherwise Truncate fails and the others do nothing.
+func NewSeekerStorage(rws io.ReadWriteSeeker) Storage {
+	s := &seekerStorage{rws: rws}
+	s.at, _ = rws.(io.ReaderAt)
+	return s
+}
+
+func (s *seekerStorage) ReadAt(p []byte, off int64) (n int, err error) {
+	if s.at != nil {
+		return s.at.ReadAt(p, off)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err = s.rws.Seek(off, os.SEEK_SET); err != nil {
+		return
+	}
+	if n, err = io.ReadFull(s.rws, p); err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return
+}
+
+func (s *seekerStorage) Append(p []byte) (n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err = s.rws.Seek(0, os.SEEK_END); err != nil {
+		return
+	}
+	return s.rws.Write(p)
+}
+
+func (s *seekerStorage) Size() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.rws.Seek(0, os.SEEK_END)
+}
+
+func (s *seekerStorage) Truncate(size int64) error {
+	t, ok := s.rws.(interface {
+		Truncate(size int64) error
+	})
+	if !ok {
+		return ErrTruncateUnsupported
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return t.Truncate(size)
+}
+
+func (s *seekerStorage) Sync() error {
+	if t, ok := s.rws.(Syncer); ok {
+		return t.Sync()
+	}
+	return nil
+}
+
+func (s *seekerStorage) Close() error {
+	if c, ok := s.rws.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
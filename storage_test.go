@@ -0,0 +1,105 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Ladbrokes/bufpipe"
+	"github.com/Ladbrokes/bufpipe/mock"
+)
+
+func testStorage(t *testing.T, s bufpipe.Storage) {
+	if n, err := s.Append([]byte("Hello World")); n != 11 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 11, nil, n, err)
+	}
+	if n, err := s.Append([]byte("!")); n != 1 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 1, nil, n, err)
+	}
+
+	if n, err := s.Size(); n != 12 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 12, nil, n, err)
+	}
+
+	d := make([]byte, 5)
+	if n, err := s.ReadAt(d, 6); n != 5 || (err != nil && err != io.EOF) || string(d) != "World" {
+		t.Errorf("Expected [%v, %v, %v] got [%v, %v, %q]", 5, nil, "World", n, err, d)
+	}
+	if n, err := s.ReadAt(d, 10); n != 2 || err != io.EOF {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 2, io.EOF, n, err)
+	}
+
+	if err := s.Truncate(5); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	s.Append([]byte("!"))
+	d = make([]byte, 6)
+	if n, err := s.ReadAt(d, 0); n != 6 || (err != nil && err != io.EOF) || string(d) != "Hello!" {
+		t.Errorf("Expected [%v, %v, %v] got [%v, %v, %q]", 6, nil, "Hello!", n, err, d)
+	}
+
+	if err := s.Sync(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	f, err := ioutil.TempFile("", "teststorage")
+	if err != nil {
+		t.Fatal("Unable to create temporary file", err)
+	}
+	defer os.Remove(f.Name())
+
+	testStorage(t, bufpipe.NewStorage(f))
+}
+
+func TestSeekerStorage(t *testing.T) {
+	testStorage(t, bufpipe.NewStorage(&mock.SyncReadWriteSeekable{ReadWriteSeekable: &mock.ReadWriteSeekable{}}))
+}
+
+func TestMemoryStorage(t *testing.T) {
+	testStorage(t, bufpipe.NewMemoryStorage())
+}
+
+// seekOnly hides everything but the ReadWriteSeeker
+type seekOnly struct {
+	io.ReadWriteSeeker
+}
+
+func TestSeekerStorageUnsupported(t *testing.T) {
+	s := bufpipe.NewSeekerStorage(seekOnly{&mock.ReadWriteSeekable{}})
+
+	if err := s.Truncate(0); err != bufpipe.ErrTruncateUnsupported {
+		t.Errorf("Expected %v got %v", bufpipe.ErrTruncateUnsupported, err)
+	}
+	if err := s.Sync(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestMemoryStoragePipe(t *testing.T) {
+	p := bufpipe.NewStoragePipe(bufpipe.NewMemoryStorage())
+
+	expect := []byte("Hello World")
+	p.Write(expect)
+
+	d := make([]byte, 20)
+	if n, err := p.Read(d); n != len(expect) || err != nil || !bytes.Equal(expect, d[:n]) {
+		t.Errorf("Expected [%v, %v, %q] got [%v, %v, %q]", len(expect), nil, expect, n, err, d[:n])
+	}
+
+	l := bufpipe.NewLineIndexedStoragePipe(bufpipe.NewMemoryStorage(), bufpipe.NewMemoryStorage())
+	writeNumberedLines(t, l, 0, 20)
+	testSeekLines(t, l, 20)
+}
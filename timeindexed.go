@@ -0,0 +1,191 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"time"
+)
+
+// ErrNoTimeIndex is returned when a time based operation is used on a pipe without a time index
+var ErrNoTimeIndex = errors.New("pipe has no time index")
+
+// fillBatch is the number of lines missing from a record of each line added to it at a time
+const fillBatch = 4096
+
+// NewLineTimeIndexedPipe returns a new line indexed pipe structure that also records the
+// time each line was written in times, one little endian int64 of Unix nanoseconds per line.
+// Recorded times never go backwards, a clock step back repeats the previous time.
+func NewLineTimeIndexedPipe(data, index, times io.ReadWriteSeeker) *LineIndexedPipe {
+	return newLineIndexedPipe(NewStorage(data), NewStorage(index), WithTimeIndex(NewStorage(times)))
+}
+
+// SeekTime sets the reader position to the beginning of the first line written at or after t.
+// If no such line exists the reader is positioned where the next line will start.
+func (l *LineIndexedPipe) SeekTime(t time.Time) (err error) {
+	if l.times == nil {
+		return ErrNoTimeIndex
+	}
+
+	var line int64
+	offset, err := func() (offset int64, err error) {
+		l.wl.Lock()
+		defer l.wl.Unlock()
+
+		if line, err = l.searchTime(t); err != nil {
+			return
+		}
+
+		if line == l.lines {
+			return l.lastIndex, nil
+		}
+
+		return l.lineOffset(line)
+	}()
+
+	l.l.Lock()
+	defer l.l.Unlock()
+
+	if err != nil {
+		l.rerr = err
+		return
+	}
+
+	l.readIndex = offset
+	if l.sums != nil {
+		l.seekCursor(line, offset)
+	}
+
+	return
+}
+
+// LinesBetween returns the range of lines written at or after from and before to, as the
+// first line in the range and the line following the last. The range is empty if first == last.
+func (l *LineIndexedPipe) LinesBetween(from, to time.Time) (first, last int64, err error) {
+	l.wl.Lock()
+	defer l.wl.Unlock()
+
+	if l.times == nil {
+		return 0, 0, ErrNoTimeIndex
+	}
+
+	if first, err = l.searchTime(from); err != nil {
+		return
+	}
+	if last, err = l.searchTime(to); err != nil {
+		return
+	}
+	if last < first {
+		last = first
+	}
+
+	return
+}
+
+// searchTime returns the first line written at or after t
+func (l *LineIndexedPipe) searchTime(t time.Time) (line int64, err error) {
+	if err = l.load(); err != nil {
+		return
+	}
+
+	// A failed index write may leave one time more than there are lines
+	var size int64
+	if size, err = l.times.Size(); err != nil {
+		return 0, pipeError("size", "times", err)
+	}
+	lines := size / int64Size
+	if lines > l.lines {
+		lines = l.lines
+	}
+
+	target := t.UnixNano()
+	i := sort.Search(int(lines), func(i int) bool {
+		if err != nil {
+			return true
+		}
+		var ts int64
+		err = readAt(l.times, int64(i)*int64Size, &ts)
+		return ts >= target
+	})
+
+	return int64(i), pipeError("read", "times", err)
+}
+
+func (l *LineIndexedPipe) writeTime(line int64) (err error) {
+	if !l.timesRead {
+		if err = l.loadTime(line); err != nil {
+			return pipeError("load", "times", err)
+		}
+	}
+
+	ts := l.now().UnixNano()
+	if ts < l.lastTime {
+		ts = l.lastTime
+	}
+
+	buf := make([]byte, int64Size)
+	binary.LittleEndian.PutUint64(buf, uint64(ts))
+	if _, err = l.times.Append(buf); err != nil {
+		return pipeError("write", "times", err)
+	}
+
+	if err = l.syncData(l.times); err != nil {
+		return pipeError("sync", "times", err)
+	}
+
+	l.lastTime = ts
+
+	return
+}
+
+// loadTime reads the time of the line before line, dropping any time recorded for line. Lines
+// written before the time index are given the time of the last line with one, or the Unix epoch.
+func (l *LineIndexedPipe) loadTime(line int64) (err error) {
+	var size int64
+	if size, err = l.times.Size(); err != nil {
+		return pipeError("size", "times", err)
+	}
+
+	// Drop the time of this line left behind by a failed index write, and any part of a time
+	have := size / int64Size
+	if have > line {
+		have = line
+	}
+	if size != have*int64Size {
+		if err = l.times.Truncate(have * int64Size); err != nil {
+			return pipeError("truncate", "times", err)
+		}
+	}
+
+	l.lastTime = 0
+	if have > 0 {
+		if err = readAt(l.times, (have-1)*int64Size, &l.lastTime); err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return pipeError("read", "times", err)
+		}
+	}
+
+	for have < line {
+		n := line - have
+		if n > fillBatch {
+			n = fillBatch
+		}
+		buf := make([]byte, 0, n*int64Size)
+		for i := int64(0); i < n; i++ {
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(l.lastTime))
+		}
+		if _, err = l.times.Append(buf); err != nil {
+			return pipeError("write", "times", err)
+		}
+		have += n
+	}
+	l.timesRead = true
+
+	return
+}
@@ -0,0 +1,52 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe
+
+import (
+	"bufio"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Ladbrokes/bufpipe/mock"
+)
+
+func TestSeekTimeIndexedPipe(t *testing.T) {
+	times := &mock.ReadWriteSeekable{}
+	p := NewLineTimeIndexedPipe(&mock.ReadWriteSeekable{}, &mock.ReadWriteSeekable{}, times)
+
+	base := time.Date(2017, 1, 6, 14, 0, 0, 0, time.UTC)
+	for i, minute := range []int{0, 5, 5, 3, 10} {
+		p.now = func() time.Time { return base.Add(time.Duration(minute) * time.Minute) }
+		if _, err := p.Write([]byte{'a' + byte(i), '\n'}); err != nil {
+			t.Errorf("Unexpected error %v", err)
+		}
+	}
+
+	// The clock stepping back to 14:03 is recorded as 14:05
+	if first, last, err := p.LinesBetween(base.Add(5*time.Minute), base.Add(10*time.Minute)); first != 1 || last != 4 || err != nil {
+		t.Errorf("Expected [%v, %v, %v] got [%v, %v, %v]", 1, 4, nil, first, last, err)
+	}
+
+	if first, last, err := p.LinesBetween(base.Add(time.Hour), base); first != 5 || last != 5 || err != nil {
+		t.Errorf("Expected [%v, %v, %v] got [%v, %v, %v]", 5, 5, nil, first, last, err)
+	}
+
+	if err := p.SeekTime(base.Add(4 * time.Minute)); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	scanner := bufio.NewScanner(p)
+	scanner.Scan()
+	if got := scanner.Text(); got != "b" {
+		t.Errorf("Expected b got %v", got)
+	}
+
+	if err := p.SeekTime(base.Add(time.Hour)); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if n, err := p.Seek(0, os.SEEK_CUR); n != 10 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 10, nil, n, err)
+	}
+}
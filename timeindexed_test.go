@@ -0,0 +1,122 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe_test
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Ladbrokes/bufpipe"
+	"github.com/Ladbrokes/bufpipe/mock"
+)
+
+func TestNoTimeIndexPipe(t *testing.T) {
+	p := bufpipe.NewLineIndexedPipe(&mock.ReadWriteSeekable{}, &mock.ReadWriteSeekable{})
+
+	if err := p.SeekTime(time.Now()); err != bufpipe.ErrNoTimeIndex {
+		t.Errorf("Expected %v got %v", bufpipe.ErrNoTimeIndex, err)
+	}
+
+	if _, _, err := p.LinesBetween(time.Now(), time.Now()); err != bufpipe.ErrNoTimeIndex {
+		t.Errorf("Expected %v got %v", bufpipe.ErrNoTimeIndex, err)
+	}
+
+	// Not having a time index does not break the pipe
+	if n, err := p.Write([]byte("Hello\n")); n != 6 || err != nil {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 6, nil, n, err)
+	}
+}
+
+func TestTimeIndexSeekFailPipe(t *testing.T) {
+	times := &mock.ReadWriteSeekable{}
+	p := bufpipe.NewLineTimeIndexedPipe(&mock.ReadWriteSeekable{}, &mock.ReadWriteSeekable{}, times)
+	times.SeekFunc = unseekableFunc
+
+	if n, err := p.Write([]byte("Hello\n")); n != 0 || !errors.Is(err, errUnseekable) {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", 0, errUnseekable, n, err)
+	}
+
+	if err := p.SeekTime(time.Now()); !errors.Is(err, errUnseekable) {
+		t.Errorf("Expected %v got %v", errUnseekable, err)
+	}
+}
+
+func TestTimeIndexExistingLinesPipe(t *testing.T) {
+	data, index := &mock.ReadWriteSeekable{}, &mock.ReadWriteSeekable{}
+	p := bufpipe.NewLineIndexedPipe(data, index)
+	p.Write([]byte("a\nb\nc\n"))
+
+	// Lines written before the time index are given the earliest time
+	p = bufpipe.NewLineTimeIndexedPipe(data, index, &mock.ReadWriteSeekable{})
+	before := time.Now()
+	if n, err := p.Write([]byte("d\n")); n != 2 || err != nil {
+		t.Fatalf("Expected [%v, %v] got [%v, %v]", 2, nil, n, err)
+	}
+
+	if first, last, err := p.LinesBetween(before, time.Now()); first != 3 || last != 4 || err != nil {
+		t.Errorf("Expected [%v, %v, %v] got [%v, %v, %v]", 3, 4, nil, first, last, err)
+	}
+	if first, last, err := p.LinesBetween(time.Unix(0, 0), before); first != 0 || last != 3 || err != nil {
+		t.Errorf("Expected [%v, %v, %v] got [%v, %v, %v]", 0, 3, nil, first, last, err)
+	}
+
+	if err := p.SeekTime(before); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	scanner := bufio.NewScanner(p)
+	scanner.Scan()
+	if got := scanner.Text(); got != "d" {
+		t.Errorf("Expected d got %v", got)
+	}
+}
+
+func TestNewLineTimeIndexedFilePipe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testtimes")
+	if err != nil {
+		t.Fatal("Unable to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, index, times := filepath.Join(dir, "data"), filepath.Join(dir, "index"), filepath.Join(dir, "times")
+
+	p, err := bufpipe.NewLineTimeIndexedFilePipe(data, index, times, 0666)
+	if err != nil {
+		t.Fatal("Unable to create IndexedFile object", err)
+	}
+
+	before := time.Now()
+	p.Write([]byte("Hello\nWorld\n"))
+	p.Close()
+
+	p, err = bufpipe.NewLineTimeIndexedFilePipe(data, index, times, 0666)
+	if err != nil {
+		t.Fatal("Unable to reopen IndexedFile object", err)
+	}
+	defer p.Close()
+
+	if first, last, err := p.LinesBetween(before, time.Now()); first != 0 || last != 2 || err != nil {
+		t.Errorf("Expected [%v, %v, %v] got [%v, %v, %v]", 0, 2, nil, first, last, err)
+	}
+
+	if err := p.SeekTime(before); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	scanner := bufio.NewScanner(p)
+	scanner.Scan()
+	if got := scanner.Text(); got != "Hello" {
+		t.Errorf("Expected Hello got %v", got)
+	}
+
+	// Unopenable times
+	os.Mkdir(filepath.Join(dir, "badtimes"), 0777)
+	if _, err := bufpipe.NewLineTimeIndexedFilePipe(data, index, filepath.Join(dir, "badtimes"), 0666); err == nil {
+		t.Error("Expected an error opening a directory as the time index")
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe
+
+import (
+	"io"
+	"math"
+	"sync/atomic"
+)
+
+// ReadAt implements the io.ReaderAt interface: it reads from the data written so far without
+// moving the read position or blocking for more, returning io.EOF if it reaches the end. It
+// can be called while the pipe is being read and written.
+func (l *Pipe) ReadAt(p []byte, off int64) (n int, err error) {
+	return l.readAt(p, off, math.MaxInt64)
+}
+
+// readAt is ReadAt of no more than the first limit bytes of the data
+func (l *Pipe) readAt(p []byte, off, limit int64) (n int, err error) {
+	l.l.Lock()
+	if l.closed {
+		l.l.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	size := l.size
+	if size > limit {
+		size = limit
+	}
+	l.reading++
+	l.l.Unlock()
+	defer l.finish(nil)
+
+	if off < 0 {
+		return 0, ErrNegativeOffset
+	}
+	if off >= size {
+		return 0, io.EOF
+	}
+	if remaining := size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+		err = io.EOF
+	}
+
+	n, rerr := l.readData(p, off)
+	if rerr != nil {
+		err = rerr
+	} else if n < len(p) {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// View returns a reader of the data written so far. It does not see later writes or move the
+// read position of the pipe, and closing it does not close the pipe. The reader also implements
+// io.ReaderAt and has a Size method, as io.SectionReader does.
+func (l *Pipe) View() io.ReadSeekCloser {
+	l.l.Lock()
+	size := l.size
+	l.l.Unlock()
+
+	return newView(l, size)
+}
+
+// newView returns a reader of the first size bytes of r that can be closed
+func newView(r io.ReaderAt, size int64) io.ReadSeekCloser {
+	v := &viewData{r: r}
+	return &view{SectionReader: io.NewSectionReader(v, 0, size), data: v}
+}
+
+type view struct {
+	*io.SectionReader
+	data *viewData
+}
+
+// Close stops further reads of the view
+func (v *view) Close() error {
+	atomic.StoreInt32(&v.data.closed, 1)
+	return nil
+}
+
+type viewData struct {
+	r      io.ReaderAt
+	closed int32
+}
+
+func (v *viewData) ReadAt(p []byte, off int64) (int, error) {
+	if atomic.LoadInt32(&v.closed) != 0 {
+		return 0, io.ErrClosedPipe
+	}
+	return v.r.ReadAt(p, off)
+}
@@ -0,0 +1,99 @@
+// Copyright 2017 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd. All rights reserved.
+// Use of this source code is governed by a MIT license that can be found in the LICENSE file.
+
+package bufpipe_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Ladbrokes/bufpipe"
+)
+
+func TestReadAtPipe(t *testing.T) {
+	p := bufpipe.NewStoragePipe(bufpipe.NewMemoryStorage())
+	p.Write([]byte("hello world"))
+
+	for _, test := range []struct {
+		off    int64
+		length int
+		expect string
+		err    error
+	}{
+		{0, 5, "hello", nil},
+		{6, 5, "world", nil},
+		{6, 10, "world", io.EOF},
+		{11, 1, "", io.EOF},
+		{-1, 1, "", bufpipe.ErrNegativeOffset},
+	} {
+		d := make([]byte, test.length)
+		n, err := p.ReadAt(d, test.off)
+		if err != test.err || string(d[:n]) != test.expect {
+			t.Errorf("Expected [%v, %q] got [%v, %q]", test.err, test.expect, err, string(d[:n]))
+		}
+	}
+
+	// The read position is not moved
+	d := make([]byte, 5)
+	if n, err := p.Read(d); err != nil || string(d[:n]) != "hello" {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", nil, "hello", err, string(d[:n]))
+	}
+
+	p.Close()
+	if _, err := p.ReadAt(d, 0); err != io.ErrClosedPipe {
+		t.Errorf("Expected %v got %v", io.ErrClosedPipe, err)
+	}
+}
+
+func TestViewPipe(t *testing.T) {
+	p := bufpipe.NewStoragePipe(bufpipe.NewMemoryStorage())
+	p.Write([]byte("hello world"))
+
+	v := p.View()
+	p.Write([]byte(" and more"))
+
+	if d, err := ioutil.ReadAll(v); err != nil || string(d) != "hello world" {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", nil, "hello world", err, string(d))
+	}
+
+	if n, err := v.Seek(-5, os.SEEK_END); err != nil || n != 6 {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", nil, 6, err, n)
+	}
+	if d, err := ioutil.ReadAll(v); err != nil || string(d) != "world" {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", nil, "world", err, string(d))
+	}
+
+	v.Seek(0, os.SEEK_SET)
+	v.Close()
+	if _, err := v.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+		t.Errorf("Expected %v got %v", io.ErrClosedPipe, err)
+	}
+
+	// Closing the view leaves the pipe open
+	d := make([]byte, 20)
+	if n, err := p.Read(d); err != nil || string(d[:n]) != "hello world and more" {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", nil, "hello world and more", err, string(d[:n]))
+	}
+}
+
+func TestViewServeContent(t *testing.T) {
+	p := bufpipe.NewStoragePipe(bufpipe.NewMemoryStorage())
+	p.Write([]byte("hello world"))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Range", "bytes=6-")
+	w := httptest.NewRecorder()
+
+	v := p.View()
+	defer v.Close()
+	http.ServeContent(w, r, "", time.Time{}, v)
+
+	if w.Code != http.StatusPartialContent || w.Body.String() != "world" {
+		t.Errorf("Expected [%v, %v] got [%v, %v]", http.StatusPartialContent, "world", w.Code, w.Body.String())
+	}
+}